@@ -0,0 +1,196 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/protos"
+	"github.com/dgraph-io/badger/y"
+	"github.com/pkg/errors"
+)
+
+// Number of KVs written to a backup as one length-prefixed protos.KVList.
+const backupBatchCount = 1000
+
+func writeTo(list *protos.KVList, w io.Writer) error {
+	buf, err := list.Marshal()
+	if err != nil {
+		return err
+	}
+	var lenBuf [8]byte
+	binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(buf)))
+	if _, err = w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// Backup dumps a protobuf-encoded list of all entries in the database into the
+// given writer, that are newer than the specified version. It returns a
+// timestamp indicating when the entries were dumped which can be passed into a
+// later invocation to generate an incremental dump, of entries that have been
+// added/modified since the last invocation of DB.Backup().
+//
+// The backup is taken from a snapshot of the database, so it's safe to run it
+// while the database is in use. Every version of a key is included, along with
+// delete markers, so the incremental dumps can be loaded on top of each other.
+//
+// This can be used to backup the data in a database at a given point in time.
+func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.keepDeleted = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	list := &protos.KVList{}
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if item.Version() <= since {
+			// Already part of an earlier backup.
+			continue
+		}
+
+		kv := &protos.KV{
+			Key:       y.Safecopy(nil, item.Key()),
+			UserMeta:  []byte{item.UserMeta()},
+			Version:   item.Version(),
+			ExpiresAt: item.ExpiresAt(),
+			Deleted:   item.meta&bitDelete != 0,
+		}
+		if !kv.Deleted {
+			val, err := item.Value()
+			if err != nil {
+				return 0, err
+			}
+			kv.Value = y.Safecopy(nil, val)
+		}
+		list.Kv = append(list.Kv, kv)
+
+		if len(list.Kv) >= backupBatchCount {
+			if err := writeTo(list, w); err != nil {
+				return 0, err
+			}
+			list.Kv = list.Kv[:0]
+		}
+	}
+	if len(list.Kv) > 0 {
+		if err := writeTo(list, w); err != nil {
+			return 0, err
+		}
+	}
+	return txn.readTs, nil
+}
+
+// Load reads a protobuf-encoded list of all entries from a reader and writes
+// them to the database. This can be used to restore the data from a full
+// backup, followed by the incremental backups taken since, in the same order.
+// The versions of the entries are kept as they were in the backup.
+//
+// DB.Load() should be called on a database that is not running any other
+// concurrent transactions while it is running.
+func (db *DB) Load(r io.Reader) error {
+	br := bufio.NewReaderSize(r, 16<<10)
+	unmarshalBuf := make([]byte, 1<<10)
+	var entries []*entry
+	var size int64
+	var maxVersion uint64
+
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		if err := db.batchSet(entries); err != nil {
+			return err
+		}
+		entries = entries[:0]
+		size = 0
+		return nil
+	}
+
+	for {
+		var sz uint64
+		err := binary.Read(br, binary.LittleEndian, &sz)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "While reading backup")
+		}
+
+		if cap(unmarshalBuf) < int(sz) {
+			unmarshalBuf = make([]byte, sz)
+		}
+		if _, err = io.ReadFull(br, unmarshalBuf[:sz]); err != nil {
+			return errors.Wrap(err, "While reading backup")
+		}
+
+		list := &protos.KVList{}
+		if err := list.Unmarshal(unmarshalBuf[:sz]); err != nil {
+			return errors.Wrap(err, "While decoding backup")
+		}
+
+		for _, kv := range list.Kv {
+			e := &entry{
+				Key:       y.KeyWithTs(kv.Key, kv.Version),
+				Value:     kv.Value,
+				ExpiresAt: kv.ExpiresAt,
+			}
+			if len(kv.UserMeta) > 0 {
+				e.UserMeta = kv.UserMeta[0]
+			}
+			if kv.Deleted {
+				e.Meta = bitDelete
+			}
+			if kv.Version > maxVersion {
+				maxVersion = kv.Version
+			}
+
+			// Leave some room for the entry being added, like the txn size checks do.
+			esz := int64(db.opt.estimateSize(e))
+			if int64(len(entries))+1 >= db.opt.maxBatchCount || size+esz >= db.opt.maxBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			entries = append(entries, e)
+			size += esz
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// Make the loaded versions visible to the transactions started from now on.
+	orc := db.orc
+	orc.Lock()
+	if orc.nextCommit <= maxVersion {
+		orc.nextCommit = maxVersion + 1
+	}
+	if atomic.LoadUint64(&orc.curRead) < maxVersion {
+		atomic.StoreUint64(&orc.curRead, maxVersion)
+	}
+	orc.Unlock()
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%04d", i))
+	}
+	// Values above the threshold go to the value log.
+	val := func(i, round int) []byte {
+		return []byte(fmt.Sprintf("%40d-%d", i, round))
+	}
+	N := 2500 // Enough for a few lists in the backup.
+	for i := 0; i < N; i++ {
+		txnSet(t, db, key(i), val(i, 0), byte(i%3))
+	}
+	txnDelete(t, db, key(0))
+
+	var full bytes.Buffer
+	ts, err := db.Backup(&full, 0)
+	require.NoError(t, err)
+
+	// Changes after the full backup go into an incremental one.
+	txnSet(t, db, key(0), val(0, 1), 0)
+	txnDelete(t, db, key(1))
+	var incr bytes.Buffer
+	ts2, err := db.Backup(&incr, ts)
+	require.NoError(t, err)
+	require.True(t, ts2 > ts)
+
+	dir2, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+	db2, err := Open(getTestOptions(dir2))
+	require.NoError(t, err)
+	defer db2.Close()
+
+	// Compares all the versions of all the keys, including delete markers.
+	versions := func(db *DB) []string {
+		var out []string
+		require.NoError(t, db.View(func(txn *Txn) error {
+			opts := DefaultIteratorOptions
+			opts.AllVersions = true
+			opts.keepDeleted = true
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				v, err := item.Value()
+				require.NoError(t, err)
+				out = append(out, fmt.Sprintf("%s@%d meta=%d user=%d val=%s",
+					item.Key(), item.Version(), item.meta&bitDelete, item.UserMeta(), v))
+			}
+			return nil
+		}))
+		return out
+	}
+
+	require.NoError(t, db2.Load(&full))
+	require.NoError(t, db2.View(func(txn *Txn) error {
+		_, err := txn.Get(key(0))
+		require.Equal(t, ErrKeyNotFound, err)
+		item, err := txn.Get(key(N - 1))
+		require.NoError(t, err)
+		require.Equal(t, val(N-1, 0), getItemValue(t, item))
+		require.Equal(t, byte((N-1)%3), item.UserMeta())
+		return nil
+	}))
+
+	require.NoError(t, db2.Load(&incr))
+	require.Equal(t, versions(db), versions(db2))
+
+	// New writes to the restored DB get versions above the loaded ones.
+	txnSet(t, db2, key(1), val(1, 2), 0)
+	require.NoError(t, db2.View(func(txn *Txn) error {
+		item, err := txn.Get(key(1))
+		require.NoError(t, err)
+		require.Equal(t, val(1, 2), getItemValue(t, item))
+		require.True(t, item.Version() > ts2)
+		return nil
+	}))
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+)
+
+// Maximum number of commits a WriteBatch keeps in flight, before blocking on Set or Delete.
+const maxPendingBatchCommits = 16
+
+// WriteBatch holds the necessary info to perform batched writes. It is meant for bulk loading
+// data, and splits the writes into as many transactions as needed, committing them in the
+// background. Writes done via a WriteBatch don't take part in conflict detection.
+//
+// A WriteBatch is not thread-safe.
+type WriteBatch struct {
+	txn *Txn
+	db  *DB
+
+	wg       sync.WaitGroup
+	throttle chan struct{}
+	mu       sync.Mutex // Guards err, which the commit callbacks set.
+	err      error
+}
+
+// NewWriteBatch creates a new WriteBatch. This provides a way to conveniently do a lot of writes,
+// batching them up as tightly as possible in a single transaction and using callbacks to avoid
+// waiting for them to commit, thus achieving good performance. This API hides away the logic of
+// creating and committing transactions. Due to the nature of SSI guaratees provided by Badger,
+// blind writes can never encounter transaction conflicts (ErrConflict).
+//
+// Flush must be called once all the writes have been done, to wait for them to be committed.
+func (db *DB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		db:       db,
+		txn:      db.newWriteBatchTxn(),
+		throttle: make(chan struct{}, maxPendingBatchCommits),
+	}
+}
+
+func (db *DB) newWriteBatchTxn() *Txn {
+	txn := db.NewTransaction(true)
+	txn.noConflicts = true
+	return txn
+}
+
+func (wb *WriteBatch) callback(err error) {
+	<-wb.throttle
+	defer wb.wg.Done()
+	if err == nil {
+		return
+	}
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if wb.err != nil {
+		return
+	}
+	wb.err = err
+}
+
+func (wb *WriteBatch) firstErr() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	return wb.err
+}
+
+// Set is equivalent of Txn.Set. The key and value must remain valid until Flush returns.
+func (wb *WriteBatch) Set(key, val []byte, userMeta byte) error {
+	e := &entry{
+		Key:      key,
+		Value:    val,
+		UserMeta: userMeta,
+	}
+	return wb.setEntry(e)
+}
+
+// Delete is equivalent of Txn.Delete.
+func (wb *WriteBatch) Delete(key []byte) error {
+	e := &entry{
+		Key:  key,
+		Meta: bitDelete,
+	}
+	return wb.setEntry(e)
+}
+
+func (wb *WriteBatch) setEntry(e *entry) error {
+	if err := wb.firstErr(); err != nil {
+		return err
+	}
+	if err := wb.txn.setEntry(e); err != ErrTxnTooBig {
+		return err
+	}
+	// The txn is full. Commit it, and retry in a new one.
+	if err := wb.commit(); err != nil {
+		return err
+	}
+	return wb.txn.setEntry(e)
+}
+
+// commit sends the current txn off to be written in the background, and starts a new one.
+func (wb *WriteBatch) commit() error {
+	if len(wb.txn.pendingWrites) == 0 {
+		return nil
+	}
+	wb.throttle <- struct{}{}
+	wb.wg.Add(1)
+	if err := wb.txn.Commit(wb.callback); err != nil {
+		<-wb.throttle
+		wb.wg.Done()
+		return err
+	}
+	wb.txn = wb.db.newWriteBatchTxn()
+	return nil
+}
+
+// Flush must be called at the end to ensure that any pending writes get committed to Badger.
+// Flush returns the first error encountered by any of the batched commits.
+func (wb *WriteBatch) Flush() error {
+	err := wb.commit()
+	wb.txn.Discard()
+	wb.wg.Wait()
+	if err != nil {
+		return err
+	}
+	return wb.firstErr()
+}
+
+// Cancel function must be called if there's a chance that Flush might not get called. If Flush
+// has already been called, Cancel is a no-op.
+func (wb *WriteBatch) Cancel() {
+	wb.txn.Discard()
+	wb.wg.Wait()
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%10d", i))
+	}
+	val := func(i int) []byte {
+		return []byte(fmt.Sprintf("%128d", i))
+	}
+
+	// Far more than fits into a single transaction with the test options.
+	N, M := 5000, 1000
+	wb := db.NewWriteBatch()
+	for i := 0; i < N; i++ {
+		require.NoError(t, wb.Set(key(i), val(i), 0))
+	}
+	for i := 0; i < M; i++ {
+		require.NoError(t, wb.Delete(key(i)))
+	}
+	require.NoError(t, wb.Flush())
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		opt := DefaultIteratorOptions
+		it := txn.NewIterator(opt)
+		defer it.Close()
+
+		i := M
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			require.Equal(t, string(key(i)), string(item.Key()))
+			valcopy, err := item.Value()
+			require.NoError(t, err)
+			require.Equal(t, val(i), valcopy)
+			i++
+		}
+		require.Equal(t, N, i)
+		return nil
+	}))
+}
@@ -20,8 +20,9 @@ badger_info
 Usage: badger_info --dir x [--value-dir y]
 
 This command prints information about the badger key-value store.  It reads MANIFEST and prints its
-info. It also prints info about missing/extra files, and general information about the value log
-files (which are not referenced by the manifest).  Use this tool to report any issues about Badger
+info, along with the properties recorded in the footer of every table. It also prints info about
+missing/extra files, and general information about the value log files (which are not referenced by
+the manifest).  Use this tool to report any issues about Badger
 to the Dgraph team.
 */
 package main
@@ -37,6 +38,7 @@ import (
 	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/options"
 	"github.com/dgraph-io/badger/table"
 )
 
@@ -106,6 +108,7 @@ func printInfo(dir, valueDir string) error {
 
 	numMissing := 0
 	numEmpty := 0
+	numUnreadable := 0
 
 	levelSizes := make([]int64, len(manifest.Levels))
 	for level, lm := range manifest.Levels {
@@ -130,9 +133,18 @@ func printInfo(dir, valueDir string) error {
 					numEmpty++
 				}
 				levelSizes[level] += fileSize
+				propsString := ""
+				if fileSize > 0 {
+					if props, err := tableProperties(filepath.Join(dir, tableFile)); err != nil {
+						propsString = fmt.Sprintf(" [UNREADABLE: %v]", err)
+						numUnreadable++
+					} else {
+						propsString = " " + props.String()
+					}
+				}
 				// (Put level on every line to make easier to process with sed/perl.)
-				fmt.Printf("%-12s %10d  %s %d%s\n", tableFile, fileSize,
-					file.ModTime().Format(time.RFC3339), level, emptyString)
+				fmt.Printf("%-12s %10d  %s %d%s%s\n", tableFile, fileSize,
+					file.ModTime().Format(time.RFC3339), level, emptyString, propsString)
 			} else {
 				fmt.Printf("%s [MISSING]\n", tableFile)
 				numMissing++
@@ -204,7 +216,8 @@ func printInfo(dir, valueDir string) error {
 	fmt.Printf("Total index size: %d\n", totalIndexSize)
 	fmt.Printf("Value log size: %d\n", valueLogSize)
 	totalExtra := numExtra + numValueDirExtra
-	if totalExtra == 0 && numMissing == 0 && numEmpty == 0 && !manifestTruncated {
+	if totalExtra == 0 && numMissing == 0 && numEmpty == 0 && numUnreadable == 0 &&
+		!manifestTruncated {
 		fmt.Println("Abnormalities: None.")
 	} else {
 		fmt.Println("Abnormalities:")
@@ -212,11 +225,27 @@ func printInfo(dir, valueDir string) error {
 	fmt.Printf("%d extra %s.\n", totalExtra, pluralFiles(totalExtra))
 	fmt.Printf("%d missing %s.\n", numMissing, pluralFiles(numMissing))
 	fmt.Printf("%d empty %s.\n", numEmpty, pluralFiles(numEmpty))
+	fmt.Printf("%d unreadable %s.\n", numUnreadable, pluralFiles(numUnreadable))
 	fmt.Printf("%d truncated %s.\n", boolToNum(manifestTruncated), pluralManifest(manifestTruncated))
 
 	return nil
 }
 
+// tableProperties reads the properties from the footer of the table file.
+func tableProperties(filename string) (table.Properties, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return table.Properties{}, err
+	}
+	t, err := table.OpenTable(fd, options.FileIO, options.NoVerification, nil, nil)
+	if err != nil {
+		return table.Properties{}, err
+	}
+	// Close the table, rather than DecrRef it, which would delete the file.
+	defer t.Close()
+	return t.Properties(), nil
+}
+
 func boolToNum(x bool) int {
 	if x {
 		return 1
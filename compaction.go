@@ -63,6 +63,20 @@ func (r keyRange) overlapsWith(dst keyRange) bool {
 	return true
 }
 
+// userRange is a range of user keys, [start, end]. A nil end has no upper bound.
+type userRange struct {
+	start []byte
+	end   []byte
+}
+
+// overlaps returns true if the table holds keys in the range.
+func (r userRange) overlaps(t *table.Table) bool {
+	if bytes.Compare(y.ParseKey(t.Biggest()), r.start) < 0 {
+		return false
+	}
+	return r.end == nil || bytes.Compare(y.ParseKey(t.Smallest()), r.end) <= 0
+}
+
 func getKeyRange(tables []*table.Table) keyRange {
 	y.AssertTrue(len(tables) > 0)
 	smallest := tables[0].Smallest()
@@ -170,7 +184,8 @@ func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd compactDef)
 	// running parallel compactions for the same level.
 	// NOTE: We can directly call thisLevel.totalSize, because we already have acquire a read lock
 	// over this and the next level.
-	if cd.thisLevel.totalSize-thisLevel.delSize < cd.thisLevel.maxTotalSize {
+	// Manual compactions run regardless.
+	if cd.manual == nil && cd.thisLevel.totalSize-thisLevel.delSize < cd.thisLevel.maxTotalSize {
 		return false
 	}
 
@@ -19,8 +19,9 @@ package badger
 import (
 	"bytes"
 	"container/heap"
+	"encoding/binary"
 	"expvar"
-	"log"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
@@ -48,6 +49,7 @@ type closers struct {
 	memtable   *y.Closer
 	writes     *y.Closer
 	valueGC    *y.Closer
+	pub        *y.Closer
 }
 
 // DB provides the various functions required to interact with Badger.
@@ -67,15 +69,27 @@ type DB struct {
 	manifest  *manifestFile
 	lc        *levelsController
 	vlog      valueLog
+	registry  *keyRegistry // The data keys the tables and value log are encrypted with.
 	vptr      valuePointer // less than or equal to a pointer to the last vlog value put into mt
 	writeCh   chan *request
 	flushChan chan flushTask // For flushing memtables.
 
+	// blockWrites is set while DropAll or DropPrefix run. writeLock guards it and writeCh, and is
+	// held in read mode while sending a request to writeCh.
+	writeLock   sync.RWMutex
+	blockWrites bool
+
 	// Incremented in the non-concurrently accessed write loop.  But also accessed outside. So
 	// we use an atomic op.
 	lastUsedCommitTs uint64
 
-	orc *oracle
+	orc        *oracle
+	pub        *publisher
+	blockCache *table.Cache // Shared by all the tables.
+	health     *health
+
+	// Limits the rate of the writes of compactions, memtable flushes and value log rewrites.
+	compactionLimiter *y.RateLimiter
 }
 
 const (
@@ -118,15 +132,15 @@ func replayFunction(out *DB) func(entry, valuePointer) error {
 			nv = make([]byte, len(e.Value))
 			copy(nv, e.Value)
 		} else {
-			nv = make([]byte, vptrSize)
-			vp.Encode(nv)
+			nv = vp.Encode(make([]byte, maxVptrSize))
 			meta = meta | bitValuePointer
 		}
 
 		v := y.ValueStruct{
-			Value:    nv,
-			Meta:     meta,
-			UserMeta: e.UserMeta,
+			Value:     nv,
+			Meta:      meta,
+			UserMeta:  e.UserMeta,
+			ExpiresAt: e.ExpiresAt,
 		}
 
 		if e.Meta&bitFinTxn > 0 {
@@ -208,9 +222,23 @@ func Open(opt Options) (db *DB, err error) {
 			_ = valueDirLockGuard.release()
 		}
 	}()
-	if !(opt.ValueLogFileSize <= 2<<30 && opt.ValueLogFileSize >= 1<<20) {
+	if !(opt.ValueLogFileSize <= maxValueLogFileSize && opt.ValueLogFileSize >= 1<<20) {
 		return nil, ErrValueLogSize
 	}
+	if !(opt.BloomFalsePositive > 0 && opt.BloomFalsePositive < 1) {
+		return nil, ErrBloomFalsePositive
+	}
+	if opt.NumVersionsToKeep < 1 {
+		return nil, ErrNumVersionsToKeep
+	}
+	switch len(opt.EncryptionKey) {
+	case 0, 16, 24, 32:
+	default:
+		return nil, ErrInvalidEncryptionKey
+	}
+	if len(opt.EncryptionKey) > 0 && opt.EncryptionKeyRotationDuration <= 0 {
+		return nil, ErrInvalidEncryptionKeyRotation
+	}
 	manifestFile, manifest, err := openOrCreateManifestFile(opt.Dir)
 	if err != nil {
 		return nil, err
@@ -226,25 +254,43 @@ func Open(opt Options) (db *DB, err error) {
 		nextCommit:     1,
 		pendingCommits: make(map[uint64]struct{}),
 		commits:        make(map[uint64]uint64),
+		inFlight:       make(map[uint64]map[string]*entry),
+		readMarks:      make(map[uint64]int),
 	}
 	heap.Init(&orc.commitMark)
 
+	elog := trace.NewEventLog("Badger", "DB")
 	db = &DB{
 		imm:           make([]*skl.Skiplist, 0, opt.NumMemtables),
 		flushChan:     make(chan flushTask, opt.NumMemtables),
 		writeCh:       make(chan *request, kvWriteChCapacity),
 		opt:           opt,
 		manifest:      manifestFile,
-		elog:          trace.NewEventLog("Badger", "DB"),
+		elog:          elog,
 		dirLockGuard:  dirLockGuard,
 		valueDirGuard: valueDirLockGuard,
 		orc:           orc,
+		pub:           newPublisher(),
+		blockCache:    table.NewCache(opt.BlockCacheSize),
+		health:        newHealth(elog, opt.OnBackgroundError),
 	}
+	db.compactionLimiter = y.NewRateLimiter(opt.CompactionBytesPerSec, db.compactionBoost)
 
 	db.closers.updateSize = y.NewCloser(1)
 	go db.updateSize(db.closers.updateSize)
 	db.mt = skl.NewSkiplist(arenaSize(opt))
 
+	if db.registry, err = openKeyRegistry(opt.Dir, opt.EncryptionKey,
+		opt.EncryptionKeyRotationDuration); err != nil {
+		return nil, err
+	}
+
+	// Compactions count the garbage they leave in the value log, so these are needed before they
+	// start.
+	if db.vlog.discardStats, err = openDiscardStats(opt.ValueDir); err != nil {
+		return nil, err
+	}
+
 	// newLevelsController potentially loads files in directory.
 	if db.lc, err = newLevelsController(db, &manifest); err != nil {
 		return nil, err
@@ -283,6 +329,7 @@ func Open(opt Options) (db *DB, err error) {
 	go db.doWrites(replayCloser)
 
 	if err = db.vlog.Replay(vptr, replayFunction(db)); err != nil {
+		replayCloser.SignalAndWait()
 		return db, err
 	}
 
@@ -296,6 +343,9 @@ func Open(opt Options) (db *DB, err error) {
 		return db, errors.Wrapf(err, "Unable to mmap RDWR log file")
 	}
 
+	db.closers.pub = y.NewCloser(1)
+	go db.pub.listenForUpdates(db.closers.pub)
+
 	db.writeCh = make(chan *request, kvWriteChCapacity)
 	db.closers.writes = y.NewCloser(1)
 	go db.doWrites(db.closers.writes)
@@ -319,6 +369,9 @@ func (db *DB) Close() (err error) {
 	// Stop writes next.
 	db.closers.writes.SignalAndWait()
 
+	// Deliver the remaining updates to the subscribers, and end the subscriptions.
+	db.closers.pub.SignalAndWait()
+
 	// Now close the value log.
 	if vlogErr := db.vlog.Close(); err == nil {
 		err = errors.Wrap(vlogErr, "DB.Close")
@@ -498,17 +551,19 @@ func (db *DB) writeToLSM(b *request) error {
 		if db.shouldWriteValueToLSM(*entry) { // Will include deletion / tombstone case.
 			db.mt.Put(entry.Key,
 				y.ValueStruct{
-					Value:    entry.Value,
-					Meta:     entry.Meta,
-					UserMeta: entry.UserMeta,
+					Value:     entry.Value,
+					Meta:      entry.Meta,
+					UserMeta:  entry.UserMeta,
+					ExpiresAt: entry.ExpiresAt,
 				})
 		} else {
-			var offsetBuf [vptrSize]byte
+			var offsetBuf [maxVptrSize]byte
 			db.mt.Put(entry.Key,
 				y.ValueStruct{
-					Value:    b.Ptrs[i].Encode(offsetBuf[:]),
-					Meta:     entry.Meta | bitValuePointer,
-					UserMeta: entry.UserMeta,
+					Value:     b.Ptrs[i].Encode(offsetBuf[:]),
+					Meta:      entry.Meta | bitValuePointer,
+					UserMeta:  entry.UserMeta,
+					ExpiresAt: entry.ExpiresAt,
 				})
 		}
 	}
@@ -543,7 +598,8 @@ func (db *DB) writeRequests(reqs []*request) error {
 			continue
 		}
 		count += len(b.Entries)
-		for err := db.ensureRoomForWrite(); err != nil; err = db.ensureRoomForWrite() {
+		var err error
+		for err = db.ensureRoomForWrite(); err == errNoRoom; err = db.ensureRoomForWrite() {
 			db.elog.Printf("Making room for writes")
 			// We need to poll a bit because both hasRoomForWrite and the flusher need access to s.imm.
 			// When flushChan is full and you are blocked there, and the flusher is trying to update s.imm,
@@ -560,6 +616,7 @@ func (db *DB) writeRequests(reqs []*request) error {
 		}
 		db.updateOffset(b.Ptrs)
 	}
+	db.pub.sendUpdates(reqs)
 	done(nil)
 	db.elog.Printf("%d entries written", count)
 	return nil
@@ -570,8 +627,12 @@ func (db *DB) doWrites(lc *y.Closer) {
 	pendingCh := make(chan struct{}, 1)
 
 	writeRequests := func(reqs []*request) {
+		// The requests get the error. It's only recorded here, so that writes which keep failing
+		// make the DB read-only.
 		if err := db.writeRequests(reqs); err != nil {
-			log.Printf("ERROR in Badger::writeRequests: %v", err)
+			db.health.failed(taskWrite, err)
+		} else {
+			db.health.succeeded(taskWrite)
 		}
 		<-pendingCh
 	}
@@ -637,6 +698,14 @@ func (db *DB) sendToWriteCh(entries []*entry) (*request, error) {
 
 	// We can only service one request because we need each txn to be stored in a contigous section.
 	// Txns should not interleave among other txns or rewrites.
+	db.writeLock.RLock()
+	defer db.writeLock.RUnlock()
+	if db.blockWrites {
+		return nil, ErrBlockedWrites
+	}
+	if db.health.error() != nil {
+		return nil, ErrReadOnlyDB
+	}
 	req := requestPool.Get().(*request)
 	req.Entries = entries
 	req.Wg = sync.WaitGroup{}
@@ -697,6 +766,10 @@ func (db *DB) ensureRoomForWrite() error {
 	}
 
 	y.AssertTrue(db.mt != nil) // A nil mt indicates that DB is being closed.
+	if db.health.error() != nil {
+		// The memtables might not get flushed anymore, so they're not piled up in imm.
+		return ErrReadOnlyDB
+	}
 	select {
 	case db.flushChan <- flushTask{db.mt, db.vptr}:
 		db.elog.Printf("Flushing value log to disk if async mode.")
@@ -724,17 +797,21 @@ func arenaSize(opt Options) int64 {
 }
 
 // WriteLevel0Table flushes memtable. It drops deleteValues.
-func writeLevel0Table(s *skl.Skiplist, f *os.File) error {
+func writeLevel0Table(s *skl.Skiplist, f io.Writer, opt Options, dk *y.DataKey) error {
 	iter := s.NewIterator()
 	defer iter.Close()
-	b := table.NewTableBuilder()
+	b := table.NewTableBuilder(opt.Compression, opt.BloomFalsePositive, dk)
 	defer b.Close()
 	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
 		if err := b.Add(iter.Key(), iter.Value()); err != nil {
 			return err
 		}
 	}
-	_, err := f.Write(b.Finish())
+	data, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
 	return err
 }
 
@@ -743,6 +820,11 @@ type flushTask struct {
 	vptr valuePointer
 }
 
+// flushMemtable writes out the memtables handed over through flushChan to level 0, until it gets
+// a nil one. A failed flush is retried with a backoff. If it keeps failing, the DB goes read-only,
+// and no more memtables are flushed: they stay in db.imm, to be read from, and their writes get
+// replayed from the value log once the DB is reopened. If the DB goes read-only because of some
+// other task, the memtables handed over are still flushed.
 func (db *DB) flushMemtable(lc *y.Closer) error {
 	defer lc.Done()
 
@@ -751,59 +833,81 @@ func (db *DB) flushMemtable(lc *y.Closer) error {
 			return nil
 		}
 
-		if !ft.mt.Empty() {
-			// Store badger head even if vptr is zero, need it for readTs
-			db.elog.Printf("Storing offset: %+v\n", ft.vptr)
-			offset := make([]byte, vptrSize)
-			ft.vptr.Encode(offset)
-
-			// Pick the max commit ts, so in case of crash, our read ts would be higher than all the
-			// commits.
-			headTs := y.KeyWithTs(head, db.orc.commitTs())
-			ft.mt.Put(headTs, y.ValueStruct{Value: offset})
+		for !db.health.gaveUp(taskFlush) {
+			err := db.handleFlushTask(ft)
+			if err == nil {
+				db.health.succeeded(taskFlush)
+				break
+			}
+			if db.health.failed(taskFlush, err) {
+				break
+			}
+			time.Sleep(db.health.backoff(taskFlush))
 		}
+	}
+	return nil
+}
 
-		fileID := db.lc.reserveFileID()
-		fd, err := y.CreateSyncedFile(table.NewFilename(fileID, db.opt.Dir), true)
-		if err != nil {
-			return y.Wrap(err)
-		}
+// handleFlushTask writes out the memtable of ft to a new level 0 table.
+func (db *DB) handleFlushTask(ft flushTask) error {
+	if !ft.mt.Empty() {
+		// Store badger head even if vptr is zero, need it for readTs
+		db.elog.Printf("Storing offset: %+v\n", ft.vptr)
+		offset := ft.vptr.Encode(make([]byte, maxVptrSize))
+
+		// Pick the max commit ts, so in case of crash, our read ts would be higher than all the
+		// commits.
+		headTs := y.KeyWithTs(head, db.orc.commitTs())
+		ft.mt.Put(headTs, y.ValueStruct{Value: offset})
+	}
 
-		// Don't block just to sync the directory entry.
-		dirSyncCh := make(chan error)
-		go func() { dirSyncCh <- syncDir(db.opt.Dir) }()
+	dk, err := db.registry.latestDataKey()
+	if err != nil {
+		return err
+	}
+	fileID := db.lc.reserveFileID()
+	filename := table.NewFilename(fileID, db.opt.Dir)
+	fd, err := y.CreateSyncedFile(filename, true)
+	if err != nil {
+		return y.Wrap(err)
+	}
 
-		err = writeLevel0Table(ft.mt, fd)
-		dirSyncErr := <-dirSyncCh
+	// Don't block just to sync the directory entry.
+	dirSyncCh := make(chan error)
+	go func() { dirSyncCh <- syncDir(db.opt.Dir) }()
 
-		if err != nil {
-			db.elog.Errorf("ERROR while writing to level 0: %v", err)
-			return err
-		}
-		if dirSyncErr != nil {
-			db.elog.Errorf("ERROR while syncing level directory: %v", dirSyncErr)
-			return err
-		}
+	err = writeLevel0Table(ft.mt, db.compactionLimiter.Writer(fd), db.opt, dk)
+	dirSyncErr := <-dirSyncCh
 
-		tbl, err := table.OpenTable(fd, db.opt.TableLoadingMode)
-		if err != nil {
-			db.elog.Printf("ERROR while opening table: %v", err)
-			return err
-		}
-		// We own a ref on tbl.
-		err = db.lc.addLevel0Table(tbl) // This will incrRef (if we don't error, sure)
-		tbl.DecrRef()                   // Releases our ref.
-		if err != nil {
-			return err
-		}
+	if err == nil && dirSyncErr != nil {
+		err = errors.Wrap(dirSyncErr, "While syncing level directory")
+	}
+	if err != nil {
+		// Clean up, so that a retry starts afresh.
+		_ = fd.Close()
+		_ = os.Remove(filename)
+		return errors.Wrap(err, "While writing to level 0")
+	}
 
-		// Update s.imm. Need a lock.
-		db.Lock()
-		y.AssertTrue(ft.mt == db.imm[0]) //For now, single threaded.
-		db.imm = db.imm[1:]
-		ft.mt.DecrRef() // Return memory.
-		db.Unlock()
+	tbl, err := table.OpenTable(fd, db.opt.TableLoadingMode, db.opt.ChecksumVerificationMode,
+		db.blockCache, db.registry)
+	if err != nil {
+		_ = os.Remove(filename)
+		return errors.Wrap(err, "While opening level 0 table")
 	}
+	// We own a ref on tbl.
+	err = db.lc.addLevel0Table(tbl) // This will incrRef (if we don't error, sure)
+	tbl.DecrRef()                   // Releases our ref.
+	if err != nil {
+		return err
+	}
+
+	// Update s.imm. Need a lock.
+	db.Lock()
+	y.AssertTrue(ft.mt == db.imm[0]) //For now, single threaded.
+	db.imm = db.imm[1:]
+	ft.mt.DecrRef() // Return memory.
+	db.Unlock()
 	return nil
 }
 
@@ -977,10 +1081,11 @@ func (db *DB) PurgeOlderVersions() error {
 // result in a space reclaim. Every run would in the best case rewrite only one log file. So,
 // repeated calls may be necessary.
 //
-// The way it currently works is that it would randomly pick up a value log file, and sample it. If
-// the sample shows that we can discard at least discardRatio space of that file, it would be
-// rewritten. Else, an ErrNoRewrite error would be returned indicating that the GC didn't result in
-// any file rewrite.
+// Compactions keep count of the space in each value log file taken up by the values of the entries
+// they drop. GC picks the file with the highest ratio of such space to its size. If at least
+// discardRatio of that file can be discarded, it would be rewritten. Else, an ErrNoRewrite error
+// would be returned indicating that the GC didn't result in any file rewrite. The counts are kept
+// in the value dir, so they survive a restart.
 //
 // We recommend setting discardRatio to 0.5, thus indicating that a file be rewritten if half the
 // space can be discarded.  This results in a lifetime value log write amplification of 2 (1 from
@@ -999,3 +1104,343 @@ func (db *DB) RunValueLogGC(discardRatio float64) error {
 	}
 	return db.vlog.runGC(discardRatio)
 }
+
+// Sequence represents a Badger sequence.
+type Sequence struct {
+	mu        sync.Mutex // Guards next and leased.
+	db        *DB
+	key       []byte
+	next      uint64
+	leased    uint64
+	bandwidth uint64
+}
+
+// Next would return the next integer in the sequence, updating the lease by running a transaction
+// if needed.
+func (seq *Sequence) Next() (uint64, error) {
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+	if seq.next >= seq.leased {
+		if err := seq.updateLease(); err != nil {
+			return 0, err
+		}
+	}
+	val := seq.next
+	seq.next++
+	return val, nil
+}
+
+// Release the leased sequence to avoid wasted integers. This should be done right
+// before closing the associated DB. However it is valid to use the sequence after
+// it was released, causing a new lease with full bandwidth.
+func (seq *Sequence) Release() error {
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+	err := seq.db.Update(func(txn *Txn) error {
+		item, err := txn.Get(seq.key)
+		if err != nil {
+			return err
+		}
+		val, err := item.Value()
+		if err != nil {
+			return err
+		}
+		if num := binary.BigEndian.Uint64(val); num != seq.leased {
+			return errors.Errorf("Undefined state. Sequence leased till %d, but stored lease is %d",
+				seq.leased, num)
+		}
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], seq.next)
+		return txn.Set(seq.key, buf[:], 0)
+	})
+	if err != nil {
+		return err
+	}
+	seq.leased = seq.next
+	return nil
+}
+
+func (seq *Sequence) updateLease() error {
+	var next, lease uint64
+	err := seq.db.Update(func(txn *Txn) error {
+		item, err := txn.Get(seq.key)
+		if err == ErrKeyNotFound {
+			next = 0
+		} else if err != nil {
+			return err
+		} else {
+			val, err := item.Value()
+			if err != nil {
+				return err
+			}
+			next = binary.BigEndian.Uint64(val)
+		}
+
+		lease = next + seq.bandwidth
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], lease)
+		return txn.Set(seq.key, buf[:], 0)
+	})
+	if err != nil {
+		return err
+	}
+	// Only take the lease once it has been committed.
+	seq.next, seq.leased = next, lease
+	return nil
+}
+
+// GetSequence would initiate a new sequence object, generating it from the stored lease, if
+// available, in the database. Sequence can be used to get a list of monotonically increasing
+// integers. Multiple sequences can be created by providing different keys. Bandwidth sets the
+// size of the lease, determining how many Next() requests can be served from memory.
+//
+// Release should be called once the Sequence is no longer needed, so that the unused part of the
+// lease is available to the next Sequence created on the same key.
+func (db *DB) GetSequence(key []byte, bandwidth uint64) (*Sequence, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if bandwidth == 0 {
+		return nil, ErrZeroBandwidth
+	}
+	seq := &Sequence{
+		db:        db,
+		key:       key,
+		bandwidth: bandwidth,
+	}
+	if err := seq.updateLease(); err != nil {
+		return nil, err
+	}
+	return seq, nil
+}
+
+// blockWrite makes new writes fail with ErrBlockedWrites, and waits for the pending ones to be
+// applied. It returns ErrBlockedWrites if writes are already blocked.
+func (db *DB) blockWrite() error {
+	db.writeLock.Lock()
+	if db.blockWrites {
+		db.writeLock.Unlock()
+		return ErrBlockedWrites
+	}
+	db.blockWrites = true
+	db.writeLock.Unlock()
+
+	// No more requests can be sent now, so the write loop can be stopped. It applies the
+	// requests already sent before returning.
+	db.closers.writes.SignalAndWait()
+	return nil
+}
+
+func (db *DB) unblockWrite() {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	db.writeCh = make(chan *request, kvWriteChCapacity)
+	db.closers.writes = y.NewCloser(1)
+	go db.doWrites(db.closers.writes)
+	db.blockWrites = false
+}
+
+// stopMemoryFlush stops the memtable flusher, once it has written out the memtables handed over
+// to it. If flush is set, the current memtable is handed over first, otherwise it's discarded.
+// Writes must be blocked.
+func (db *DB) stopMemoryFlush(flush bool) error {
+	if flush && !db.mt.Empty() {
+		// Ensure value log is synced to disk so this memtable's contents wouldn't be lost.
+		if err := db.vlog.sync(); err != nil {
+			return err
+		}
+		for {
+			pushed := func() bool {
+				db.Lock()
+				defer db.Unlock()
+				select {
+				case db.flushChan <- flushTask{db.mt, db.vptr}:
+					db.imm = append(db.imm, db.mt) // Flusher will attempt to remove this from s.imm.
+					db.mt = skl.NewSkiplist(arenaSize(db.opt))
+					return true
+				default:
+					// The flusher needs to update s.imm, so unlock and retry after a while.
+					return false
+				}
+			}()
+			if pushed {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	} else if !flush {
+		db.Lock()
+		db.mt.DecrRef()
+		db.mt = skl.NewSkiplist(arenaSize(db.opt))
+		db.Unlock()
+	}
+	db.flushChan <- flushTask{nil, valuePointer{}} // Tell flusher to quit.
+	db.closers.memtable.Wait()
+	return nil
+}
+
+func (db *DB) startMemoryFlush() {
+	db.closers.memtable = y.NewCloser(1)
+	go db.flushMemtable(db.closers.memtable)
+}
+
+func (db *DB) stopCompactions() {
+	db.closers.compactors.SignalAndWait()
+}
+
+func (db *DB) startCompactions() {
+	db.closers.compactors = y.NewCloser(1)
+	db.lc.startCompact(db.closers.compactors)
+}
+
+// DropAll drops all the data stored in Badger. It does this in the following way.
+// - Stop accepting new writes.
+// - Pause memtable flushes and compactions.
+// - Discard the memtables and delete all the SSTables, via manifest changes.
+// - Delete all the value log files, writing to a new one from then on.
+// - Resume memtable flushes, compactions and writes.
+//
+// Writes done while DropAll runs fail with ErrBlockedWrites. It fails with ErrReadOnlyDB once the
+// DB is read-only. Once it returns, reads don't see any of the dropped data. Iterators which were already open keep seeing their snapshot, and hold on
+// to the files they're reading until they're closed.
+func (db *DB) DropAll() error {
+	// Let any running value log GC finish first, and block new ones.
+	db.vlog.garbageCh <- struct{}{}
+	defer func() { <-db.vlog.garbageCh }()
+
+	if err := db.blockWrite(); err != nil {
+		return err
+	}
+	defer db.unblockWrite()
+	if db.health.error() != nil {
+		return ErrReadOnlyDB
+	}
+
+	db.elog.Printf("DropAll called. Blocking writes...")
+	if err := db.stopMemoryFlush(false); err != nil {
+		return err
+	}
+	defer db.startMemoryFlush()
+	db.stopCompactions()
+	defer db.startCompactions()
+
+	num, err := db.lc.dropTree()
+	if err != nil {
+		return err
+	}
+	db.elog.Printf("Deleted %d SSTables. Now deleting value logs...\n", num)
+
+	num, err = db.vlog.dropAll()
+	if err != nil {
+		return err
+	}
+	db.Lock()
+	db.vptr = valuePointer{}
+	db.Unlock()
+	db.elog.Printf("Deleted %d value log files. DropAll done.\n", num)
+	return nil
+}
+
+// DropPrefix drops all the keys with the provided prefix. It does this in the following way:
+// - Stop accepting new writes.
+// - Flush out the memtables to level 0, then pause compactions.
+// - Delete the SSTables which only hold keys with the prefix, via manifest changes.
+// - Rewrite the SSTables which hold keys both with and without the prefix, leaving out the
+//   prefixed ones.
+// - Resume compactions and writes.
+//
+// Writes done while DropPrefix runs fail with ErrBlockedWrites. It fails with ErrReadOnlyDB once
+// the DB is read-only. The space taken up by the dropped values in the value log is reclaimed by
+// value log GC.
+func (db *DB) DropPrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrEmptyKey
+	}
+	if err := db.blockWrite(); err != nil {
+		return err
+	}
+	defer db.unblockWrite()
+	if db.health.error() != nil {
+		return ErrReadOnlyDB
+	}
+
+	db.elog.Printf("DropPrefix called on %q. Blocking writes...", prefix)
+	if err := db.stopMemoryFlush(true); err != nil {
+		return err
+	}
+	db.startMemoryFlush()
+	db.stopCompactions()
+	defer db.startCompactions()
+
+	if err := db.lc.dropPrefix(prefix); err != nil {
+		return err
+	}
+	db.elog.Printf("DropPrefix done")
+	return nil
+}
+
+// compactionBoost returns the factor by which the limit on the compaction rate is raised, as level 0
+// fills up. It doubles with each table above NumLevelZeroTables, and the limit is lifted once
+// writes stall.
+func (db *DB) compactionBoost() float64 {
+	n := db.lc.levels[0].numTables()
+	switch {
+	case n >= db.opt.NumLevelZeroTablesStall:
+		return math.Inf(1)
+	case n <= db.opt.NumLevelZeroTables:
+		return 1
+	}
+	return math.Pow(2, float64(n-db.opt.NumLevelZeroTables))
+}
+
+// SetCompactionBytesPerSec changes the limit on the rate of the writes of compactions, memtable
+// flushes and value log rewrites, set by Options.CompactionBytesPerSec. A rate of 0 lifts it.
+func (db *DB) SetCompactionBytesPerSec(rate int64) {
+	db.compactionLimiter.SetRate(rate)
+}
+
+// CompactRange pushes the SSTables holding keys in [start, end] down to the last level of the LSM
+// tree, compacting them with the tables they overlap on the way. A nil end has no upper bound.
+// It's meant to be run after a bulk load, to get the tree into its final shape without waiting for
+// the background compactions. The tables written to the range while it runs might be left behind.
+//
+// Background compactions keep running alongside. CompactRange waits for those holding the tables
+// it needs, and returns the first error it runs into.
+func (db *DB) CompactRange(start, end []byte) error {
+	if end != nil && bytes.Compare(start, end) > 0 {
+		return ErrInvalidRequest
+	}
+	r := userRange{start: start, end: end}
+	for l := 0; l+1 < db.opt.MaxLevels; l++ {
+		if err := db.lc.compactManually(l, r, db.opt.NumCompactors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flatten compacts all the SSTables into a single level of the LSM tree: the last level holding
+// any of them, or level 1 if they're all on level 0. Up to workers compactions run at a time, and
+// workers must be at least 1, otherwise an ErrInvalidRequest is returned.
+//
+// Like CompactRange, it runs alongside background compactions, and returns the first error it runs
+// into. The tables written while it runs might be left on the levels above.
+func (db *DB) Flatten(workers int) error {
+	if workers < 1 {
+		return ErrInvalidRequest
+	}
+	last := 1
+	for l := len(db.lc.levels) - 1; l > 1; l-- {
+		if db.lc.levels[l].numTables() > 0 {
+			last = l
+			break
+		}
+	}
+	for l := 0; l < last; l++ {
+		if err := db.lc.compactManually(l, userRange{}, workers); err != nil {
+			return err
+		}
+	}
+	db.elog.Printf("Flatten done, tables are on level %d", last)
+	return nil
+}
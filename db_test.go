@@ -24,11 +24,14 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/dgraph-io/badger/options"
 	"github.com/dgraph-io/badger/y"
 	"github.com/stretchr/testify/require"
 )
@@ -628,6 +631,53 @@ func TestIterateDeleted(t *testing.T) {
 	}
 }
 
+func TestSetWithTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	long := []byte("long")
+	short := []byte("short")
+	val := []byte("value-with-ttl-0123456789012345")
+
+	txn := kv.NewTransaction(true)
+	require.NoError(t, txn.SetWithTTL(long, val, 0x01, time.Hour))
+	// A negative TTL leaves the entry already expired.
+	require.NoError(t, txn.SetWithTTL(short, val, 0x01, -time.Second))
+	_, err = txn.Get(short)
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, txn.Commit(nil))
+
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		item, err := txn.Get(long)
+		require.NoError(t, err)
+		require.Equal(t, val, getItemValue(t, item))
+		require.Equal(t, byte(0x01), item.UserMeta())
+		require.True(t, item.ExpiresAt() > uint64(time.Now().Unix()))
+
+		_, err = txn.Get(short)
+		require.Equal(t, ErrKeyNotFound, err)
+
+		var keys []string
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Item().Key()))
+		}
+		require.Equal(t, []string{"long"}, keys)
+		return nil
+	}))
+
+	// The expired value is garbage as far as the value log is concerned.
+	vs, err := kv.get(y.KeyWithTs(short, math.MaxUint64))
+	require.NoError(t, err)
+	e := entry{Key: y.KeyWithTs(short, vs.Version), Value: val}
+	require.True(t, discardEntry(e, vs))
+}
+
 func TestDirNotExists(t *testing.T) {
 	_, err := Open(getTestOptions("not-exists"))
 	require.Error(t, err)
@@ -963,6 +1013,592 @@ func TestPurgeOlderVersions(t *testing.T) {
 	})
 }
 
+func TestSequence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	_, err = kv.GetSequence([]byte("seq"), 0)
+	require.Equal(t, ErrZeroBandwidth, err)
+
+	key := []byte("seq")
+	seq, err := kv.GetSequence(key, 10)
+	require.NoError(t, err)
+	for i := uint64(0); i < 25; i++ {
+		num, err := seq.Next()
+		require.NoError(t, err)
+		require.Equal(t, i, num)
+	}
+
+	// A concurrent sequence on the same key leases past the current lease.
+	other, err := kv.GetSequence(key, 10)
+	require.NoError(t, err)
+	num, err := other.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), num)
+	// Which means the first sequence can no longer give its lease back.
+	require.Error(t, seq.Release())
+	require.NoError(t, other.Release())
+
+	// Release gives back the unused part of the lease.
+	seq, err = kv.GetSequence(key, 10)
+	require.NoError(t, err)
+	num, err = seq.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(31), num)
+	require.NoError(t, seq.Release())
+	num, err = seq.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(32), num)
+}
+
+func populateForDrop(t *testing.T, kv *DB, prefixes []string, n int) {
+	// Values above the threshold go to the value log.
+	val := []byte(fmt.Sprintf("%64d", 0))
+	wb := kv.NewWriteBatch()
+	for i := 0; i < n; i++ {
+		for _, p := range prefixes {
+			require.NoError(t, wb.Set([]byte(fmt.Sprintf("%s%06d", p, i)), val, 0))
+		}
+	}
+	require.NoError(t, wb.Flush())
+}
+
+func countKeys(t *testing.T, kv *DB, prefix string) int {
+	var count int
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		opt := DefaultIteratorOptions
+		opt.PrefetchValues = false
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			count++
+		}
+		return nil
+	}))
+	return count
+}
+
+func TestDropAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueLogFileSize = 5 << 20
+	kv, err := Open(opts)
+	require.NoError(t, err)
+
+	N := 10000
+	populateForDrop(t, kv, []string{"key"}, N)
+	require.Equal(t, N, countKeys(t, kv, ""))
+
+	require.NoError(t, kv.DropAll())
+	require.Equal(t, 0, countKeys(t, kv, ""))
+	for _, l := range kv.lc.levels {
+		require.Equal(t, 0, l.numTables())
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.vlog"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(files))
+
+	// Writes work fine after DropAll, and survive a restart.
+	populateForDrop(t, kv, []string{"new"}, 100)
+	require.Equal(t, 100, countKeys(t, kv, ""))
+	require.NoError(t, kv.Close())
+
+	kv, err = Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+	require.Equal(t, 100, countKeys(t, kv, ""))
+	require.Equal(t, 100, countKeys(t, kv, "new"))
+}
+
+func TestDropPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	kv, err := Open(opts)
+	require.NoError(t, err)
+
+	N := 5000
+	populateForDrop(t, kv, []string{"aa", "bb", "cc"}, N)
+	require.Equal(t, 3*N, countKeys(t, kv, ""))
+
+	require.NoError(t, kv.DropPrefix([]byte("bb")))
+	require.Equal(t, N, countKeys(t, kv, "aa"))
+	require.Equal(t, 0, countKeys(t, kv, "bb"))
+	require.Equal(t, N, countKeys(t, kv, "cc"))
+	require.NoError(t, kv.validate())
+
+	// The dropped values are garbage in the value log, whether their tables were deleted or
+	// rewritten.
+	var discarded int64
+	kv.vlog.discardStats.Lock()
+	for _, n := range kv.vlog.discardStats.bytes {
+		discarded += n
+	}
+	kv.vlog.discardStats.Unlock()
+	require.True(t, discarded >= int64(N*64), "Discarded: %d", discarded)
+
+	// The dropped keys stay gone after a restart.
+	txnSet(t, kv, []byte("dd"), []byte("dd"), 0)
+	require.NoError(t, kv.Close())
+	kv, err = Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+	require.Equal(t, 2*N+1, countKeys(t, kv, ""))
+	require.Equal(t, 0, countKeys(t, kv, "bb"))
+}
+
+func TestDropPrefixWaitsForLevel0(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	for i := 0; i < 100; i++ {
+		txnSet(t, kv, []byte(fmt.Sprintf("aa%03d", i)), []byte("v"), 0)
+		txnSet(t, kv, []byte(fmt.Sprintf("bb%03d", i)), []byte("v"), 0)
+	}
+	flushMemtable(t, kv)
+	require.Equal(t, 1, kv.lc.levels[0].numTables())
+
+	// Hold level 0 as if it was being compacted, so that DropPrefix has to wait for it.
+	cd := compactDef{
+		thisLevel: kv.lc.levels[0],
+		nextLevel: kv.lc.levels[1],
+		thisRange: infRange,
+		nextRange: infRange,
+		manual:    &userRange{},
+	}
+	require.True(t, kv.lc.cstatus.compareAndAdd(thisAndNextLevelRLocked{}, cd))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		kv.lc.cstatus.delete(cd)
+	}()
+
+	require.NoError(t, kv.DropPrefix([]byte("bb")))
+	require.Equal(t, 100, countKeys(t, kv, "aa"))
+	require.Equal(t, 0, countKeys(t, kv, "bb"))
+}
+
+// flushMemtable writes out the memtable to level 0.
+func flushMemtable(t *testing.T, kv *DB) {
+	require.NoError(t, kv.blockWrite())
+	require.NoError(t, kv.stopMemoryFlush(true))
+	kv.startMemoryFlush()
+	kv.unblockWrite()
+}
+
+// flushAndCompact writes out the memtable to level 0, and then compacts level 0 into level 1.
+// The memtable must not be empty.
+func flushAndCompact(t *testing.T, kv *DB) {
+	flushMemtable(t, kv)
+	done, err := kv.lc.doCompact(compactionPriority{level: 0})
+	require.NoError(t, err)
+	require.True(t, done)
+}
+
+// countVersions returns the number of versions of key in txn, deletions included.
+func countVersions(t *testing.T, txn *Txn, key string) int {
+	opts := DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.keepDeleted = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	var count int
+	for it.Seek([]byte(key)); it.ValidForPrefix([]byte(key)); it.Next() {
+		count++
+	}
+	return count
+}
+
+func TestCompactionDropsOldVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	txnSet(t, kv, []byte("answer"), []byte("41"), 0)
+	reader := kv.NewTransaction(false)
+	txnSet(t, kv, []byte("answer"), []byte("42"), 0)
+	txnSet(t, kv, []byte("answer"), []byte("43"), 0)
+	txnSet(t, kv, []byte("deleted"), []byte("1"), 0)
+	txnDelete(t, kv, []byte("deleted"))
+
+	// The open transaction still reads the oldest version, so nothing can be dropped.
+	flushAndCompact(t, kv)
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		require.Equal(t, 3, countVersions(t, txn, "answer"))
+		require.Equal(t, 2, countVersions(t, txn, "deleted"))
+		return nil
+	}))
+	item, err := reader.Get([]byte("answer"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("41"), getItemValue(t, item))
+	reader.Discard()
+
+	// Now, only the latest version of each key is visible. The deletion has reached the last
+	// level holding the key, so it's dropped along with the version it deleted.
+	txnSet(t, kv, []byte("other"), []byte("value"), 0)
+	flushAndCompact(t, kv)
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		require.Equal(t, 1, countVersions(t, txn, "answer"))
+		require.Equal(t, 0, countVersions(t, txn, "deleted"))
+		item, err := txn.Get([]byte("answer"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("43"), getItemValue(t, item))
+		return nil
+	}))
+}
+
+func TestCompactionManagedDiscardTs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.ManagedTxns = true
+	opts.NumVersionsToKeep = 2
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	for ts := uint64(1); ts <= 4; ts++ {
+		txn := kv.NewTransactionAt(ts, true)
+		require.NoError(t, txn.Set([]byte("answer"), []byte(fmt.Sprintf("%d", ts)), 0))
+		require.NoError(t, txn.CommitAt(ts, nil))
+	}
+
+	// Without a discard timestamp, every version is kept.
+	flushAndCompact(t, kv)
+	txn := kv.NewTransactionAt(4, false)
+	require.Equal(t, 4, countVersions(t, txn, "answer"))
+	txn.Discard()
+
+	// The version above the discard timestamp is kept, along with the 2 latest at or below it.
+	kv.SetDiscardTs(3)
+	txn = kv.NewTransactionAt(5, true)
+	require.NoError(t, txn.Set([]byte("other"), []byte("value"), 0))
+	require.NoError(t, txn.CommitAt(5, nil))
+	flushAndCompact(t, kv)
+	txn = kv.NewTransactionAt(4, false)
+	require.Equal(t, 3, countVersions(t, txn, "answer"))
+	txn.Discard()
+}
+
+func TestCompactRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	require.Equal(t, ErrInvalidRequest, kv.CompactRange([]byte("b"), []byte("a")))
+
+	N := 1000
+	populateForDrop(t, kv, []string{"aa", "bb", "cc"}, N)
+	flushMemtable(t, kv)
+	require.NoError(t, kv.CompactRange([]byte("bb"), []byte("bb~")))
+
+	// Only the last level holds tables with keys in the range.
+	last := opts.MaxLevels - 1
+	r := userRange{start: []byte("bb"), end: []byte("bb~")}
+	var found, above bool
+	for _, l := range kv.lc.levels {
+		for _, tbl := range l.tables {
+			if r.overlaps(tbl) {
+				require.Equal(t, last, l.level)
+				found = true
+			} else if l.level < last {
+				above = true
+			}
+		}
+	}
+	require.True(t, found)
+	require.True(t, above, "Tables out of the range shouldn't all be pushed down")
+	for _, p := range []string{"aa", "bb", "cc"} {
+		require.Equal(t, N, countKeys(t, kv, p))
+	}
+	require.NoError(t, kv.validate())
+}
+
+func TestFlatten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	require.Equal(t, ErrInvalidRequest, kv.Flatten(0))
+
+	N := 1000
+	populateForDrop(t, kv, []string{"aa", "cc"}, N)
+	flushMemtable(t, kv)
+	require.NoError(t, kv.CompactRange(nil, nil))
+	populateForDrop(t, kv, []string{"bb"}, N)
+	flushAndCompact(t, kv)
+	populateForDrop(t, kv, []string{"dd"}, N)
+	flushMemtable(t, kv)
+
+	require.NoError(t, kv.Flatten(2))
+	var levels []int
+	for _, l := range kv.lc.levels {
+		if l.numTables() > 0 {
+			levels = append(levels, l.level)
+		}
+	}
+	require.Equal(t, []int{opts.MaxLevels - 1}, levels)
+	require.Equal(t, 4*N, countKeys(t, kv, ""))
+	require.NoError(t, kv.validate())
+}
+
+func TestSubcompactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.NumLevelZeroTablesStall = 100
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	N := 20000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%06d", i)) }
+	val := func(i, v int) []byte { return []byte(fmt.Sprintf("%06d-%d", i, v)) }
+	set := func(v int) {
+		wb := kv.NewWriteBatch()
+		for i := 0; i < N; i++ {
+			switch {
+			case v > 0 && i%3 == 0:
+				require.NoError(t, wb.Delete(key(i)))
+			case v == 0 || i%3 == 1:
+				require.NoError(t, wb.Set(key(i), val(i, v), 0))
+			}
+		}
+		require.NoError(t, wb.Flush())
+	}
+	set(0)
+	flushAndCompact(t, kv)
+	splits := kv.lc.subcompactionSplits(compactDef{bot: kv.lc.levels[1].tables})
+	require.Equal(t, maxSubcompactions-1, len(splits))
+	// Small compactions aren't split.
+	require.Equal(t, 0, len(kv.lc.subcompactionSplits(
+		compactDef{bot: kv.lc.levels[1].tables[:minSubcompactionTables+1]})))
+
+	// Overwrite and delete keys all across the splits.
+	set(1)
+	flushAndCompact(t, kv)
+	require.NoError(t, kv.lc.validate())
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		for i := 0; i < N; i++ {
+			item, err := txn.Get(key(i))
+			switch i % 3 {
+			case 0:
+				require.Equal(t, ErrKeyNotFound, err)
+				continue
+			case 1:
+				require.NoError(t, err)
+				require.Equal(t, val(i, 1), getItemValue(t, item))
+			case 2:
+				require.NoError(t, err)
+				require.Equal(t, val(i, 0), getItemValue(t, item))
+			}
+		}
+		// Each subcompaction got all the versions of its keys, and dropped the older ones along
+		// with the deletions.
+		require.Equal(t, N-(N+2)/3, countVersions(t, txn, "key"))
+		return nil
+	}))
+	for _, split := range splits {
+		require.Equal(t, 1, countKeys(t, kv, string(split)))
+	}
+}
+
+// The compression of each block is recorded in it, so the tables written with any compression
+// can be read no matter what the DB is opened with, and compacted together.
+func TestChangeCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+
+	key := func(ct options.CompressionType, i int) []byte {
+		return []byte(fmt.Sprintf("key%d-%04d", ct, i))
+	}
+	val := func(i int) []byte { return []byte(fmt.Sprintf("%0100d", i)) }
+	cts := []options.CompressionType{options.None, options.Snappy, options.ZSTD}
+	check := func(kv *DB, cts []options.CompressionType) {
+		require.NoError(t, kv.View(func(txn *Txn) error {
+			for _, ct := range cts {
+				for i := 0; i < 100; i++ {
+					item, err := txn.Get(key(ct, i))
+					require.NoError(t, err)
+					require.Equal(t, val(i), getItemValue(t, item))
+				}
+			}
+			return nil
+		}))
+	}
+	for n, ct := range cts {
+		opts.Compression = ct
+		kv, err := Open(opts)
+		require.NoError(t, err)
+		check(kv, cts[:n])
+		wb := kv.NewWriteBatch()
+		for i := 0; i < 100; i++ {
+			require.NoError(t, wb.Set(key(ct, i), val(i), 0))
+		}
+		require.NoError(t, wb.Flush())
+		if n < len(cts)-1 {
+			flushMemtable(t, kv)
+		} else {
+			flushAndCompact(t, kv)
+		}
+		check(kv, cts[:n+1])
+		require.NoError(t, kv.Close())
+	}
+
+	opts.Compression = options.None
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+	check(kv, cts)
+}
+
+// copyBaselineDir copies testdata/baseline to a new directory, and returns it. That DB was written
+// before tables had a footer and value log entries could expire, as follows:
+//
+// - key000 to key199 were set to baselineValue(i), the odd ones in the value log.
+// - key000 to key009 were deleted, and key010 to key029 set to baselineValue(i+1).
+// - The DB was closed and reopened, and later000 to later049 set to baselineValue(i). The files
+// were copied before closing it again, so these are only in the value log.
+func copyBaselineDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	files, err := ioutil.ReadDir("testdata/baseline")
+	require.NoError(t, err)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join("testdata/baseline", f.Name()))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, f.Name()), data, 0666))
+	}
+	return dir
+}
+
+func baselineValue(i int) []byte {
+	if i%2 == 0 {
+		return []byte(fmt.Sprintf("v%03d", i))
+	}
+	return []byte(fmt.Sprintf("value%03d-%032d", i, 0))
+}
+
+// checkBaselineDir checks that kv holds what copyBaselineDir describes.
+func checkBaselineDir(t *testing.T, kv *DB) {
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		for i := 0; i < 200; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+			switch {
+			case i < 10:
+				require.Equal(t, ErrKeyNotFound, err)
+			case i < 30:
+				require.NoError(t, err)
+				require.Equal(t, baselineValue(i+1), getItemValue(t, item))
+			default:
+				require.NoError(t, err)
+				require.Equal(t, baselineValue(i), getItemValue(t, item))
+			}
+			if err == nil {
+				require.Zero(t, item.ExpiresAt())
+			}
+		}
+		for i := 0; i < 50; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("later%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, baselineValue(i), getItemValue(t, item))
+		}
+		return nil
+	}))
+}
+
+func TestOpenBaselineDir(t *testing.T) {
+	dir := copyBaselineDir(t)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	checkBaselineDir(t, kv)
+
+	// New entries, expiring or not, go next to the old ones.
+	require.NoError(t, kv.Update(func(txn *Txn) error {
+		if err := txn.SetWithTTL([]byte("expiring"), []byte("value"), 0, time.Hour); err != nil {
+			return err
+		}
+		return txn.Set([]byte("key000"), baselineValue(0), 0)
+	}))
+	require.NoError(t, kv.Close())
+
+	kv, err = Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("expiring"))
+		require.NoError(t, err)
+		require.NotZero(t, item.ExpiresAt())
+		item, err = txn.Get([]byte("key000"))
+		require.NoError(t, err)
+		require.Equal(t, baselineValue(0), getItemValue(t, item))
+		return nil
+	}))
+}
+
+func TestCompactionRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.CompactionBytesPerSec = 1 << 30
+	opts.NumLevelZeroTables = 2
+	opts.NumLevelZeroTablesStall = 5
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	// The limit is raised as level 0 fills up, and lifted once writes would stall.
+	boosts := []float64{1, 1, 1, 2, 4, math.Inf(1)}
+	for i, boost := range boosts {
+		require.Equal(t, i, kv.lc.levels[0].numTables())
+		require.Equal(t, boost, kv.compactionBoost())
+		if i+1 < len(boosts) {
+			txnSet(t, kv, []byte(fmt.Sprintf("key%d", i)), []byte("value"), 0)
+			flushMemtable(t, kv)
+		}
+	}
+
+	kv.SetCompactionBytesPerSec(1 << 20)
+	require.Equal(t, int64(1<<20), kv.compactionLimiter.Rate())
+}
+
 func ExampleOpen() {
 	dir, err := ioutil.TempDir("", "badger")
 	if err != nil {
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger/y"
+	"github.com/pkg/errors"
+)
+
+const (
+	// discardFilename is the name of the file in the value dir holding the discard stats.
+	discardFilename        = "DISCARD"
+	discardRewriteFilename = "DISCARD-REWRITE"
+
+	// Each entry of the file is a fid, followed by the number of bytes discarded. The entries are
+	// followed by their CRC32 (Castagnoli) checksum.
+	discardEntrySize = 4 + 8
+)
+
+// discardStats keeps count of the bytes of each value log file which are garbage, as compactions
+// drop the value pointers into them. Value log GC rewrites the file with the most garbage. The
+// counts are persisted after each compaction, and are only a hint: a crash might lose the latest
+// ones, in which case GC collects that garbage later than it could have.
+type discardStats struct {
+	sync.Mutex
+	dir   string
+	bytes map[uint32]int64
+	// live holds the fids of the value log files which haven't been deleted, so that compactions
+	// don't count bytes for files which are already gone. It's nil until the value log is opened,
+	// until when all counts are kept.
+	live map[uint32]struct{}
+}
+
+// openDiscardStats loads the discard stats from dir. Missing or corrupt stats start afresh.
+func openDiscardStats(dir string) (*discardStats, error) {
+	ds := &discardStats{dir: dir, bytes: make(map[uint32]int64)}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, discardFilename))
+	if os.IsNotExist(err) {
+		return ds, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "While reading discard stats")
+	}
+	if len(buf) < 4 || (len(buf)-4)%discardEntrySize != 0 {
+		return ds, nil
+	}
+	data, sum := buf[:len(buf)-4], buf[len(buf)-4:]
+	if crc32.Checksum(data, y.CastagnoliCrcTable) != binary.BigEndian.Uint32(sum) {
+		return ds, nil
+	}
+	for ; len(data) > 0; data = data[discardEntrySize:] {
+		fid := binary.BigEndian.Uint32(data[0:4])
+		ds.bytes[fid] = int64(binary.BigEndian.Uint64(data[4:12]))
+	}
+	return ds, nil
+}
+
+// add counts the bytes discarded by a compaction, by fid, and persists the counts.
+func (ds *discardStats) add(discarded map[uint32]int64) error {
+	if len(discarded) == 0 {
+		return nil
+	}
+	ds.Lock()
+	defer ds.Unlock()
+	for fid, n := range discarded {
+		if _, ok := ds.live[fid]; ok || ds.live == nil {
+			ds.bytes[fid] += n
+		}
+	}
+	return ds.persist()
+}
+
+// drop forgets the counts of the given fids, of files which have been deleted, and persists the
+// counts.
+func (ds *discardStats) drop(fids ...uint32) error {
+	ds.Lock()
+	defer ds.Unlock()
+	for _, fid := range fids {
+		delete(ds.bytes, fid)
+		delete(ds.live, fid)
+	}
+	return ds.persist()
+}
+
+// setLive sets the fids of the value log files, once it's opened. The counts of any other fids,
+// of files deleted before a crash, are dropped and the counts persisted.
+func (ds *discardStats) setLive(fids []uint32) error {
+	ds.Lock()
+	defer ds.Unlock()
+	ds.live = make(map[uint32]struct{}, len(fids))
+	for _, fid := range fids {
+		ds.live[fid] = struct{}{}
+	}
+	for fid := range ds.bytes {
+		if _, ok := ds.live[fid]; !ok {
+			delete(ds.bytes, fid)
+		}
+	}
+	return ds.persist()
+}
+
+// addLive adds the fid of a newly created value log file.
+func (ds *discardStats) addLive(fid uint32) {
+	ds.Lock()
+	defer ds.Unlock()
+	if ds.live != nil {
+		ds.live[fid] = struct{}{}
+	}
+}
+
+func (ds *discardStats) get(fid uint32) int64 {
+	ds.Lock()
+	defer ds.Unlock()
+	return ds.bytes[fid]
+}
+
+// persist writes out the counts to a new file, and renames it over the old one. ds must be locked.
+func (ds *discardStats) persist() error {
+	fids := make([]uint32, 0, len(ds.bytes))
+	for fid := range ds.bytes {
+		fids = append(fids, fid)
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+
+	buf := make([]byte, 0, len(fids)*discardEntrySize+4)
+	var entry [discardEntrySize]byte
+	for _, fid := range fids {
+		binary.BigEndian.PutUint32(entry[0:4], fid)
+		binary.BigEndian.PutUint64(entry[4:12], uint64(ds.bytes[fid]))
+		buf = append(buf, entry[:]...)
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(buf, y.CastagnoliCrcTable))
+	buf = append(buf, sum[:]...)
+
+	rewritePath := filepath.Join(ds.dir, discardRewriteFilename)
+	fp, err := y.OpenTruncFile(rewritePath, false)
+	if err != nil {
+		return errors.Wrap(err, "While writing discard stats")
+	}
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return errors.Wrap(err, "While writing discard stats")
+	}
+	// In Windows the files should be closed before doing a Rename.
+	if err := fp.Close(); err != nil {
+		return errors.Wrap(err, "While writing discard stats")
+	}
+	return errors.Wrap(os.Rename(rewritePath, filepath.Join(ds.dir, discardFilename)),
+		"While writing discard stats")
+}
@@ -29,7 +29,26 @@ var (
 
 	// ErrValueLogSize is returned when opt.ValueLogFileSize option is not within the valid
 	// range.
-	ErrValueLogSize = errors.New("Invalid ValueLogFileSize, must be between 1MB and 2GB")
+	ErrValueLogSize = errors.New("Invalid ValueLogFileSize, must be between 1MB and 1TB")
+
+	// ErrTruncateNeeded is returned by Open when the end of the value log is corrupt, or holds an
+	// incomplete transaction, and Options.Truncate isn't set.
+	ErrTruncateNeeded = errors.New(
+		"Value log needs to be truncated, which drops its incomplete transactions. Set Options.Truncate")
+
+	// ErrValueLogCorrupt is reported by DB.VerifyIntegrity for the value log entries which are cut
+	// short, or don't match their checksum or the key pointing to them.
+	ErrValueLogCorrupt = errors.New("Value log entry is corrupt")
+
+	// ErrValueLogFull is returned by writes once the value log has used up all the file ids.
+	ErrValueLogFull = errors.New("Value log has run out of file ids")
+
+	// ErrBloomFalsePositive is returned when opt.BloomFalsePositive option is not within the
+	// valid range.
+	ErrBloomFalsePositive = errors.New("Invalid BloomFalsePositive, must be between 0 and 1")
+
+	// ErrNumVersionsToKeep is returned when opt.NumVersionsToKeep is less than 1.
+	ErrNumVersionsToKeep = errors.New("Invalid NumVersionsToKeep, must be at least 1")
 
 	// ErrKeyNotFound is returned when key isn't found on a txn.Get.
 	ErrKeyNotFound = errors.New("Key not found")
@@ -74,6 +93,40 @@ var (
 	// ErrManagedTxn is returned if the user tries to use an API which isn't allowed due to
 	// external management of transactions.
 	ErrManagedTxn = errors.New("Invalid API request for managed transaction")
+
+	// ErrBlockedWrites is returned if the user called DropAll or DropPrefix. During the process,
+	// writes are blocked.
+	ErrBlockedWrites = errors.New("Writes are blocked, possibly due to DropAll or DropPrefix")
+
+	// ErrReadOnlyDB is returned by writes once the DB has gone read-only, because some background
+	// task kept failing. DB.BackgroundError returns the cause.
+	ErrReadOnlyDB = errors.New("DB is read-only due to a background error. Please reopen it")
+
+	// ErrNilCallback is returned when subscriber's callback is nil.
+	ErrNilCallback = errors.New("Callback cannot be nil")
+
+	// ErrZeroBandwidth is returned if the user passes in zero bandwidth for sequence.
+	ErrZeroBandwidth = errors.New("Bandwidth must be greater than zero")
+
+	// ErrMergeOperatorStopped is returned when a value is added to a MergeOperator after Stop.
+	ErrMergeOperatorStopped = errors.New("MergeOperator has been stopped")
+
+	// ErrInvalidEncryptionKey is returned if Options.EncryptionKey isn't 16, 24 or 32 bytes long.
+	ErrInvalidEncryptionKey = errors.New("Encryption key's length should be 16, 24 or 32 bytes")
+
+	// ErrInvalidEncryptionKeyRotation is returned if Options.EncryptionKeyRotationDuration isn't
+	// positive while Options.EncryptionKey is set.
+	ErrInvalidEncryptionKeyRotation = errors.New(
+		"EncryptionKeyRotationDuration must be greater than zero")
+
+	// ErrEncryptionKeyMismatch is returned when opening a DB with another encryption key than the
+	// one it was written with, or with one while it wasn't encrypted, or the other way round.
+	ErrEncryptionKeyMismatch = errors.New(
+		"Encryption key mismatch: the DB was written with another encryption key, or none")
+
+	// ErrUnknownDataKey is returned when some data is encrypted with a data key which is missing
+	// from the key registry.
+	ErrUnknownDataKey = errors.New("Data key not found in the key registry")
 )
 
 const maxKeySize = 1 << 20
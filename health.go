@@ -0,0 +1,128 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/trace"
+)
+
+// The background tasks whose failures are tracked.
+const (
+	taskFlush      = "memtable flush"
+	taskCompaction = "compaction"
+	taskWrite      = "write"
+)
+
+const (
+	// Number of consecutive failures of a background task, after which the DB goes read-only.
+	maxBackgroundFailures = 5
+
+	// How long to wait before retrying a failed background task. The backoff doubles with each
+	// consecutive failure, up to maxBackgroundBackoff.
+	minBackgroundBackoff = 100 * time.Millisecond
+	maxBackgroundBackoff = 10 * time.Second
+)
+
+// health keeps track of the failures of the background tasks. Once a task keeps failing, the DB
+// goes read-only, and stays so until it's reopened.
+type health struct {
+	sync.Mutex
+	elog     trace.EventLog
+	failures map[string]int // Consecutive failures, by task.
+	err      error          // Set once the DB has gone read-only.
+	onError  func(err error)
+}
+
+func newHealth(elog trace.EventLog, onError func(err error)) *health {
+	return &health{
+		elog:     elog,
+		failures: make(map[string]int),
+		onError:  onError,
+	}
+}
+
+// failed records a failure of the task, and returns true if the task has failed too many times
+// in a row to be retried, which makes the DB go read-only.
+func (h *health) failed(task string, err error) bool {
+	h.Lock()
+	h.failures[task]++
+	n := h.failures[task]
+	h.elog.Errorf("ERROR in background %s, %d times in a row: %v", task, n, err)
+	if h.err != nil || n < maxBackgroundFailures {
+		defer h.Unlock()
+		return n >= maxBackgroundFailures
+	}
+	h.err = errors.Wrapf(err, "Background %s failed %d times in a row", task, n)
+	log.Printf("ERROR: Badger is read-only from now on: %v", h.err)
+	onError, bgErr := h.onError, h.err
+	h.Unlock()
+
+	if onError != nil {
+		onError(bgErr)
+	}
+	return true
+}
+
+// succeeded resets the failures of the task.
+func (h *health) succeeded(task string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.failures, task)
+}
+
+// gaveUp returns true if the task has failed too many times in a row to be retried.
+func (h *health) gaveUp(task string) bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.failures[task] >= maxBackgroundFailures
+}
+
+// backoff returns how long to wait before retrying the task.
+func (h *health) backoff(task string) time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	d := minBackgroundBackoff
+	for i := 1; i < h.failures[task] && d < maxBackgroundBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackgroundBackoff {
+		d = maxBackgroundBackoff
+	}
+	return d
+}
+
+func (h *health) error() error {
+	h.Lock()
+	defer h.Unlock()
+	return h.err
+}
+
+// BackgroundError returns the error which made the DB go read-only, or nil if it's healthy.
+//
+// The memtable flushes and compactions are retried with a backoff when they fail. Once one of
+// them, or the writes to the value log, fail several times in a row, the DB goes read-only: new
+// writes, DropAll and DropPrefix fail with ErrReadOnlyDB. If it was the memtable flushes which
+// failed, no more memtables are flushed. Reads keep working. Reopening the DB recovers it,
+// replaying the writes that weren't flushed from the value log.
+func (db *DB) BackgroundError() error {
+	return db.health.error()
+}
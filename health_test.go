@@ -0,0 +1,189 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dgraph-io/badger/table"
+	"github.com/dgraph-io/badger/y"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/trace"
+)
+
+func TestHealthBackoff(t *testing.T) {
+	h := newHealth(trace.NewEventLog("Badger", "Test"), nil)
+	errFail := errors.New("failure")
+
+	require.Equal(t, minBackgroundBackoff, h.backoff(taskFlush))
+	require.False(t, h.failed(taskFlush, errFail))
+	require.Equal(t, minBackgroundBackoff, h.backoff(taskFlush))
+	require.False(t, h.failed(taskFlush, errFail))
+	require.Equal(t, 2*minBackgroundBackoff, h.backoff(taskFlush))
+
+	// The failures of the other tasks, and the earlier failures of this one, don't count.
+	require.False(t, h.failed(taskCompaction, errFail))
+	h.succeeded(taskFlush)
+	require.Equal(t, minBackgroundBackoff, h.backoff(taskFlush))
+	for i := 1; i < maxBackgroundFailures; i++ {
+		require.False(t, h.failed(taskFlush, errFail))
+	}
+	require.Equal(t, 8*minBackgroundBackoff, h.backoff(taskFlush))
+	require.NoError(t, h.error())
+
+	require.True(t, h.failed(taskFlush, errFail))
+	require.Equal(t, errFail, errors.Cause(h.error()))
+
+	for i := 0; i < 10; i++ {
+		h.failed(taskWrite, errFail)
+	}
+	require.Equal(t, maxBackgroundBackoff, h.backoff(taskWrite))
+}
+
+func TestReadOnlyOnBackgroundError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	var bgErrs []error
+	opts.OnBackgroundError = func(err error) {
+		bgErrs = append(bgErrs, err)
+	}
+	kv, err := Open(opts)
+	require.NoError(t, err)
+
+	txnSet(t, kv, []byte("key"), []byte("value"), 0)
+	require.NoError(t, kv.BackgroundError())
+
+	errCompaction := errors.New("compaction failure")
+	for i := 0; i < maxBackgroundFailures; i++ {
+		kv.health.failed(taskCompaction, errCompaction)
+	}
+	require.Equal(t, errCompaction, errors.Cause(kv.BackgroundError()))
+	require.Equal(t, 1, len(bgErrs))
+	require.Equal(t, kv.BackgroundError(), bgErrs[0])
+
+	// Writes are rejected, reads still work.
+	err = kv.Update(func(txn *Txn) error {
+		return txn.Set([]byte("key2"), []byte("value2"), 0)
+	})
+	require.Equal(t, ErrReadOnlyDB, err)
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), getItemValue(t, item))
+		return nil
+	}))
+	require.NoError(t, kv.Close())
+
+	// Reopening recovers the DB, and the writes made before it went read-only.
+	kv, err = Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+	require.NoError(t, kv.BackgroundError())
+	require.Equal(t, 1, countKeys(t, kv, "key"))
+	txnSet(t, kv, []byte("key2"), []byte("value2"), 0)
+}
+
+func TestFlushRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	kv, err := Open(opts)
+	require.NoError(t, err)
+
+	// Directories in the way of the next n table files make the flushes fail.
+	blockTables := func(n int) {
+		next := atomic.LoadUint64(&kv.lc.nextFileID)
+		for id := next; id < next+uint64(n); id++ {
+			require.NoError(t, os.Mkdir(table.NewFilename(id, dir), 0755))
+		}
+	}
+
+	// A flush that fails once goes through on the retry.
+	blockTables(1)
+	txnSet(t, kv, []byte("key1"), []byte("value1"), 0)
+	flushMemtable(t, kv)
+	require.NoError(t, kv.BackgroundError())
+	require.Equal(t, 1, kv.lc.levels[0].numTables())
+
+	// A flush that keeps failing makes the DB read-only.
+	blockTables(maxBackgroundFailures)
+	txnSet(t, kv, []byte("key2"), []byte("value2"), 0)
+	flushMemtable(t, kv)
+	require.Error(t, kv.BackgroundError())
+	require.Equal(t, 1, kv.lc.levels[0].numTables())
+	require.Equal(t, ErrReadOnlyDB, kv.Update(func(txn *Txn) error {
+		return txn.Set([]byte("key3"), []byte("value3"), 0)
+	}))
+	require.Equal(t, 2, countKeys(t, kv, "key"))
+	require.NoError(t, kv.Close())
+
+	// The writes which weren't flushed are replayed from the value log.
+	kv, err = Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+	require.NoError(t, kv.BackgroundError())
+	require.Equal(t, 2, countKeys(t, kv, "key"))
+}
+
+func TestFlushAfterCompactionFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	txnSet(t, kv, []byte("key"), []byte("value"), 0)
+	errCompaction := errors.New("compaction failure")
+	for i := 0; i < maxBackgroundFailures; i++ {
+		kv.health.failed(taskCompaction, errCompaction)
+	}
+	require.Error(t, kv.BackgroundError())
+
+	// The memtables handed over are still flushed, instead of piling up in imm.
+	flushMemtable(t, kv)
+	kv.RLock()
+	require.Equal(t, 0, len(kv.imm))
+	kv.RUnlock()
+	require.Equal(t, 1, kv.lc.levels[0].numTables())
+
+	// A full memtable isn't handed over anymore.
+	for i := 0; kv.mt.MemSize() < kv.opt.MaxTableSize; i++ {
+		kv.mt.Put(y.KeyWithTs([]byte(fmt.Sprintf("fill%d", i)), 1),
+			y.ValueStruct{Value: make([]byte, 1<<10)})
+	}
+	require.Equal(t, ErrReadOnlyDB, kv.ensureRoomForWrite())
+	kv.RLock()
+	require.Equal(t, 0, len(kv.imm))
+	kv.RUnlock()
+
+	require.Equal(t, ErrReadOnlyDB, kv.DropAll())
+	require.Equal(t, ErrReadOnlyDB, kv.DropPrefix([]byte("key")))
+	require.Equal(t, 1, countKeys(t, kv, "key"))
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/y"
+	"github.com/pkg/errors"
+)
+
+// Corruption is a corrupt part of the DB, found by DB.VerifyIntegrity.
+type Corruption struct {
+	File   string // The table or value log file.
+	Offset uint64 // Where the corrupt table block or value log entry starts in File.
+	Key    []byte // The key whose value can't be read, if it's a value pointer which is broken.
+	Err    error
+}
+
+// IntegrityReport is the outcome of DB.VerifyIntegrity.
+type IntegrityReport struct {
+	Tables        int // Number of tables verified.
+	ValueLogFiles int // Number of value log files verified.
+	ValuePointers int // Number of value pointers verified.
+	Corruptions   []Corruption
+}
+
+// VerifyIntegrity reads through the DB, to find any corruption before a read runs into it. It
+// verifies the checksums of all the blocks of the tables, and of the entries of the value log
+// files. It also makes sure that the values of the latest versions of the keys can be read from
+// the value log, and belong to these keys. A value log file can only be read up to its first
+// corrupt entry, so the entries after it aren't verified, but the keys pointing to them are
+// reported.
+//
+// The reads go at Options.VerifyBytesPerSec, and the DB can be used as usual meanwhile. The
+// corruptions found are returned in the report; an error is only returned if the verification
+// couldn't run to the end, like when ctx is done.
+func (db *DB) VerifyIntegrity(ctx context.Context) (*IntegrityReport, error) {
+	limiter := y.NewRateLimiter(db.opt.VerifyBytesPerSec, nil)
+	wait := func(n int) error {
+		limiter.Wait(n)
+		return ctx.Err()
+	}
+
+	report := &IntegrityReport{}
+	if err := db.verifyTables(report, wait); err != nil {
+		return nil, err
+	}
+
+	// No value log file is deleted while the iterator count is up.
+	db.vlog.incrIteratorCount()
+	err := db.verifyValueLog(report, wait)
+	if err == nil {
+		err = db.verifyValuePointers(report, wait)
+	}
+	if decrErr := db.vlog.decrIteratorCount(); err == nil {
+		err = decrErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (db *DB) verifyTables(report *IntegrityReport, wait func(n int) error) (err error) {
+	tables := db.lc.refTables()
+	defer func() {
+		if decrErr := decrRefs(tables); err == nil {
+			err = decrErr
+		}
+	}()
+
+	for _, t := range tables {
+		for i := 0; i < t.NumBlocks(); i++ {
+			off, size, err := t.VerifyBlock(i)
+			if err != nil {
+				report.Corruptions = append(report.Corruptions, Corruption{
+					File:   t.Filename(),
+					Offset: uint64(off),
+					Err:    err,
+				})
+			}
+			if err := wait(size); err != nil {
+				return err
+			}
+		}
+		report.Tables++
+	}
+	return nil
+}
+
+// verifyValueLog reads through the value log files, each with a file descriptor of its own, so
+// that it doesn't get in the way of the writes and GC. Only the entries written by the time it
+// starts are verified.
+func (db *DB) verifyValueLog(report *IntegrityReport, wait func(n int) error) error {
+	vlog := &db.vlog
+	vlog.filesLock.RLock()
+	fids := vlog.sortedFids()
+	maxFid := atomic.LoadUint32(&vlog.maxFid)
+	vlog.filesLock.RUnlock()
+	writable := vlog.writableOffset()
+
+	for _, fid := range fids {
+		path := vlog.fpath(fid)
+		lf := &logFile{fid: fid, path: path}
+		var err error
+		if lf.fd, err = os.Open(path); err != nil {
+			return errors.Wrapf(err, "Unable to open value log: %q", path)
+		}
+		end := writable
+		if fid != maxFid {
+			fi, err := lf.fd.Stat()
+			if err != nil {
+				lf.fd.Close()
+				return errors.Wrapf(err, "Unable to check stat for %q", path)
+			}
+			end = uint64(fi.Size())
+		}
+
+		var verified uint64 // The end of the last entry verified.
+		var waitErr error
+		err = vlog.iterate(lf, 0, func(e entry, vp valuePointer) error {
+			if vp.Offset >= end {
+				return errStop
+			}
+			verified = vp.Offset + uint64(vp.Len)
+			if waitErr = wait(int(vp.Len)); waitErr != nil {
+				return errStop
+			}
+			return nil
+		})
+		lf.fd.Close()
+		if waitErr != nil {
+			return waitErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Unable to verify value log: %q", path)
+		}
+		if verified < end {
+			report.Corruptions = append(report.Corruptions, Corruption{
+				File:   path,
+				Offset: verified,
+				Err: errors.Wrapf(ErrValueLogCorrupt,
+					"%d bytes can't be read, from offset %d", end-verified, verified),
+			})
+		}
+		report.ValueLogFiles++
+	}
+	return nil
+}
+
+// verifyValuePointers reads the values which the latest versions of the keys point to.
+func (db *DB) verifyValuePointers(report *IntegrityReport, wait func(n int) error) error {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	opts := DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if err := wait(len(item.key) + len(item.vptr)); err != nil {
+			return err
+		}
+		if item.meta&bitValuePointer == 0 {
+			continue
+		}
+		var vp valuePointer
+		vp.Decode(item.vptr)
+		if err := db.verifyValuePointer(vp, y.KeyWithTs(item.Key(), item.Version())); err != nil {
+			report.Corruptions = append(report.Corruptions, Corruption{
+				File:   db.vlog.fpath(vp.Fid),
+				Offset: vp.Offset,
+				Key:    y.Safecopy(nil, item.Key()),
+				Err:    err,
+			})
+		}
+		report.ValuePointers++
+		if err := wait(int(vp.Len)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyValuePointer reads the entry vp points to, and checks that it's whole and belongs to key.
+func (db *DB) verifyValuePointer(vp valuePointer, key []byte) error {
+	buf, cb, err := db.vlog.readValueBytes(vp)
+	if cb != nil {
+		defer cb()
+	}
+	if err != nil {
+		return errors.Wrapf(ErrValueLogCorrupt, "Unable to read entry: %v", err)
+	}
+	if len(buf) < headerBufSize+crc32.Size {
+		return errors.Wrapf(ErrValueLogCorrupt, "Entry is too short: %d bytes", len(buf))
+	}
+	n := len(buf) - crc32.Size
+	if crc32.Checksum(buf[:n], y.CastagnoliCrcTable) != binary.BigEndian.Uint32(buf[n:]) {
+		return errors.Wrap(ErrValueLogCorrupt, "Checksum mismatch")
+	}
+	e, err := db.vlog.decodeEntry(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(e.Key, key) {
+		return errors.Wrapf(ErrValueLogCorrupt, "Entry belongs to another key: %q", e.Key)
+	}
+	return nil
+}
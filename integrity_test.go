@@ -0,0 +1,132 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/options"
+	"github.com/dgraph-io/badger/table"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func flipByte(t *testing.T, filename string, off int64) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	var b [1]byte
+	_, err = f.ReadAt(b[:], off)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b[:], off)
+	require.NoError(t, err)
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.TableLoadingMode = options.MemoryMap
+	opts.DoNotCompact = true
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	for i := 0; i < 100; i++ {
+		txnSet(t, kv, []byte(fmt.Sprintf("key%03d", i)), make([]byte, 64), 0)
+		txnSet(t, kv, []byte(fmt.Sprintf("small%03d", i)), []byte("v"), 0)
+	}
+	flushMemtable(t, kv)
+
+	report, err := kv.VerifyIntegrity(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, len(report.Corruptions))
+	require.Equal(t, 1, report.Tables)
+	require.Equal(t, 1, report.ValueLogFiles)
+	require.Equal(t, 100, report.ValuePointers)
+
+	// Corrupt the value of key050 in the value log, and the first block of the table.
+	var vp valuePointer
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("key050"))
+		require.NoError(t, err)
+		vp.Decode(item.vptr)
+		return nil
+	}))
+	flipByte(t, vlogFilePath(dir, vp.Fid), int64(vp.Offset)+int64(vp.Len)/2)
+	tbl := kv.lc.levels[0].tables[0]
+	flipByte(t, table.NewFilename(tbl.ID(), dir), 10)
+
+	report, err = kv.VerifyIntegrity(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, len(report.Corruptions), "%+v", report.Corruptions)
+
+	c := report.Corruptions[0]
+	require.Equal(t, tbl.Filename(), c.File)
+	require.Equal(t, uint64(0), c.Offset)
+	require.Equal(t, table.ErrChecksumMismatch, errors.Cause(c.Err))
+
+	// The value log file can't be read past the corrupt entry.
+	c = report.Corruptions[1]
+	require.Equal(t, vlogFilePath(dir, vp.Fid), c.File)
+	require.Equal(t, vp.Offset, c.Offset)
+	require.Equal(t, ErrValueLogCorrupt, errors.Cause(c.Err))
+
+	c = report.Corruptions[2]
+	require.Equal(t, vlogFilePath(dir, vp.Fid), c.File)
+	require.Equal(t, vp.Offset, c.Offset)
+	require.Equal(t, []byte("key050"), c.Key)
+	require.Equal(t, ErrValueLogCorrupt, errors.Cause(c.Err))
+	require.Equal(t, 100, report.ValuePointers)
+}
+
+func TestVerifyIntegrityRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.VerifyBytesPerSec = 1 << 10
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	for i := 0; i < 100; i++ {
+		txnSet(t, kv, []byte(fmt.Sprintf("key%03d", i)), make([]byte, 64), 0)
+	}
+
+	// A few KB take seconds to verify, so the verification runs out of time.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = kv.VerifyIntegrity(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < 5*time.Second)
+
+	kv.opt.VerifyBytesPerSec = 0
+	report, err := kv.VerifyIntegrity(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, len(report.Corruptions))
+	require.Equal(t, 100, report.ValuePointers)
+}
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/y"
 	farm "github.com/dgryski/go-farm"
@@ -35,19 +36,20 @@ const (
 // Item is returned during iteration. Both the Key() and Value() output is only valid until
 // iterator.Next() is called.
 type Item struct {
-	status   prefetchStatus
-	err      error
-	wg       sync.WaitGroup
-	db       *DB
-	key      []byte
-	vptr     []byte
-	meta     byte
-	userMeta byte
-	val      []byte
-	slice    *y.Slice // Used only during prefetching.
-	next     *Item
-	version  uint64
-	txn      *Txn
+	status    prefetchStatus
+	err       error
+	wg        sync.WaitGroup
+	db        *DB
+	key       []byte
+	vptr      []byte
+	meta      byte
+	userMeta  byte
+	expiresAt uint64
+	val       []byte
+	slice     *y.Slice // Used only during prefetching.
+	next      *Item
+	version   uint64
+	txn       *Txn
 }
 
 // ToString returns a string representation of Item
@@ -97,6 +99,18 @@ func (item *Item) hasValue() bool {
 	return true
 }
 
+// isDeletedOrExpired returns true if the value has a delete marker, or has an expiry timestamp
+// which is in the past.
+func isDeletedOrExpired(meta byte, expiresAt uint64) bool {
+	if meta&bitDelete > 0 {
+		return true
+	}
+	if expiresAt == 0 {
+		return false
+	}
+	return expiresAt <= uint64(time.Now().Unix())
+}
+
 func (item *Item) yieldItemValue() ([]byte, func(), error) {
 	if !item.hasValue() {
 		return nil, nil, nil
@@ -160,6 +174,12 @@ func (item *Item) UserMeta() byte {
 	return item.userMeta
 }
 
+// ExpiresAt returns a Unix time value indicating when the item will be
+// considered expired. 0 indicates that the item will never expire.
+func (item *Item) ExpiresAt() uint64 {
+	return item.expiresAt
+}
+
 // TODO: Switch this to use linked list container in Go.
 type list struct {
 	head *Item
@@ -205,6 +225,8 @@ type IteratorOptions struct {
 	PrefetchSize int
 	Reverse      bool // Direction of iteration. False is forward, true is backward.
 	AllVersions  bool // Fetch all valid versions of the same key.
+
+	keepDeleted bool // Also fetch deleted and expired versions. Only used with AllVersions.
 }
 
 // DefaultIteratorOptions contains default options when iterating over Badger key-value stores.
@@ -226,31 +248,79 @@ type Iterator struct {
 	data  list
 	waste list
 
-	lastKey []byte // Used to skip over multiple versions of the same key.
+	lastKey  []byte // Used to skip over multiple versions of the same key.
+	rangeIdx int    // Index into txn.readRanges of the range being scanned, -1 if none.
 }
 
 // NewIterator returns a new iterator. Depending upon the options, either only keys, or both
 // key-value pairs would be fetched. The keys are returned in lexicographically sorted order.
 // Using prefetch is highly recommended if you're doing a long running iteration.
 // Avoid long running iterations in update transactions.
+//
+// In an update transaction, the iterator also sees the writes made so far by the transaction
+// itself. Writes made after the iterator was created are not visible to it.
 func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	tables, decr := txn.db.getMemTables()
 	defer decr()
 	txn.db.vlog.incrIteratorCount()
 	var iters []y.Iterator
+	// The txn's own writes come first, so they take precedence over committed versions.
+	if itr := txn.newPendingWritesIterator(opt.Reverse); itr != nil {
+		iters = append(iters, itr)
+	}
 	for i := 0; i < len(tables); i++ {
 		iters = append(iters, tables[i].NewUniIterator(opt.Reverse))
 	}
 	iters = txn.db.lc.appendIterators(iters, opt.Reverse) // This will increment references.
 	res := &Iterator{
-		txn:    txn,
-		iitr:   y.NewMergeIterator(iters, opt.Reverse),
-		opt:    opt,
-		readTs: txn.readTs,
+		txn:      txn,
+		iitr:     y.NewMergeIterator(iters, opt.Reverse),
+		opt:      opt,
+		readTs:   txn.readTs,
+		rangeIdx: -1,
 	}
 	return res
 }
 
+// startRange begins tracking a new key range read by the iterator, from the position it was just
+// sought to. A nil key means the iterator was rewound.
+func (it *Iterator) startRange(key []byte) {
+	if !it.txn.update {
+		return
+	}
+	var r readRange
+	if len(key) > 0 {
+		key = y.Safecopy(nil, key)
+		if !it.opt.Reverse {
+			r.start = key
+		} else {
+			r.end = key
+		}
+	}
+	it.txn.readRanges = append(it.txn.readRanges, r)
+	it.rangeIdx = len(it.txn.readRanges) - 1
+	it.updateRange()
+}
+
+// updateRange extends the range being tracked up to the current item. Once the iterator runs
+// out of items, the range is unbounded in the direction of iteration.
+func (it *Iterator) updateRange() {
+	if it.rangeIdx < 0 {
+		return
+	}
+	r := &it.txn.readRanges[it.rangeIdx]
+	switch {
+	case it.item == nil && !it.opt.Reverse:
+		r.end = nil
+	case it.item == nil:
+		r.start = nil
+	case !it.opt.Reverse:
+		r.end = append(r.end[:0], it.item.Key()...)
+	default:
+		r.start = append(r.start[:0], it.item.Key()...)
+	}
+}
+
 func (it *Iterator) newItem() *Item {
 	item := it.waste.pop()
 	if item == nil {
@@ -303,6 +373,7 @@ func (it *Iterator) Next() {
 			break
 		}
 	}
+	it.updateRange()
 }
 
 // parseItem is a complex function because it needs to handle both forward and reverse iteration
@@ -337,8 +408,8 @@ func (it *Iterator) parseItem() bool {
 	}
 
 	if it.opt.AllVersions {
-		// First check if value has been deleted
-		if mi.Value().Meta&bitDelete > 0 {
+		// First check if value has been deleted or expired.
+		if vs := mi.Value(); !it.opt.keepDeleted && isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
 			mi.Next()
 			return false
 		}
@@ -365,8 +436,8 @@ func (it *Iterator) parseItem() bool {
 	}
 
 FILL:
-	// If deleted, advance and return.
-	if mi.Value().Meta&bitDelete > 0 {
+	// If deleted or expired, advance and return.
+	if vs := mi.Value(); isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
 		mi.Next()
 		return false
 	}
@@ -398,6 +469,7 @@ func (it *Iterator) fill(item *Item) {
 	vs := it.iitr.Value()
 	item.meta = vs.Meta
 	item.userMeta = vs.UserMeta
+	item.expiresAt = vs.ExpiresAt
 
 	item.version = y.ParseTs(it.iitr.Key())
 	item.key = y.Safecopy(item.key, y.ParseKey(it.iitr.Key()))
@@ -447,9 +519,11 @@ func (it *Iterator) Seek(key []byte) {
 	if len(key) == 0 {
 		it.iitr.Rewind()
 		it.prefetch()
+		it.startRange(nil)
 		return
 	}
 
+	userKey := key
 	if !it.opt.Reverse {
 		key = y.KeyWithTs(key, it.txn.readTs)
 	} else {
@@ -457,6 +531,7 @@ func (it *Iterator) Seek(key []byte) {
 	}
 	it.iitr.Seek(key)
 	it.prefetch()
+	it.startRange(userKey)
 }
 
 // Rewind would rewind the iterator cursor all the way to zero-th position, which would be the
@@ -473,4 +548,5 @@ func (it *Iterator) Rewind() {
 	it.lastKey = it.lastKey[:0]
 	it.iitr.Rewind()
 	it.prefetch()
+	it.startRange(nil)
 }
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+	"github.com/pkg/errors"
+)
+
+const (
+	// keyRegistryFilename is the name of the file in the dir holding the data keys.
+	keyRegistryFilename        = "KEYREGISTRY"
+	keyRegistryRewriteFilename = "KEYREGISTRY-REWRITE"
+
+	// dataKeyHeaderSize is the size of the id, creation time, key length and IV stored ahead of
+	// each data key.
+	dataKeyHeaderSize = 8 + 8 + 4 + y.IVSize
+)
+
+// sanityText is stored in the key registry, encrypted with the encryption key, so that a wrong
+// key is caught when the DB is opened.
+var sanityText = []byte("Hello Badger")
+
+// keyRegistry holds the data keys which the tables and value log files are encrypted with. The
+// data keys are themselves stored encrypted with Options.EncryptionKey, so that the encryption
+// key can be kept out of the data. A new data key is generated every
+// Options.EncryptionKeyRotationDuration; the old ones are kept, as long as there might be data
+// encrypted with them.
+//
+// The file starts with the IV and the sanity text, followed by the data keys. Each data key is
+// its id, creation time, length and IV, followed by the key itself. The file ends with the
+// CRC32 (Castagnoli) checksum of all of it.
+type keyRegistry struct {
+	sync.Mutex
+	dir       string
+	masterKey *y.DataKey // nil if the DB isn't encrypted.
+	rotation  time.Duration
+	keys      map[uint64]*y.DataKey
+	createdAt map[uint64]time.Time
+	latest    uint64 // The id of the latest data key, 0 if there is none.
+}
+
+// openKeyRegistry loads the data keys from dir, decrypting them with encryptionKey, or creates
+// the registry if there is none yet. It returns ErrEncryptionKeyMismatch if the registry wasn't
+// written with encryptionKey.
+func openKeyRegistry(dir string, encryptionKey []byte,
+	rotation time.Duration) (*keyRegistry, error) {
+	kr := &keyRegistry{
+		dir:       dir,
+		rotation:  rotation,
+		keys:      make(map[uint64]*y.DataKey),
+		createdAt: make(map[uint64]time.Time),
+	}
+	if len(encryptionKey) > 0 {
+		var err error
+		if kr.masterKey, err = y.NewDataKey(0, encryptionKey); err != nil {
+			return nil, errors.Wrap(ErrInvalidEncryptionKey, err.Error())
+		}
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, keyRegistryFilename))
+	if os.IsNotExist(err) {
+		return kr, kr.persist()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "While reading key registry")
+	}
+	errCorrupt := errors.New("Key registry is corrupt")
+	if len(buf) < y.IVSize+len(sanityText)+4 {
+		return nil, errCorrupt
+	}
+	data, sum := buf[:len(buf)-4], buf[len(buf)-4:]
+	if crc32.Checksum(data, y.CastagnoliCrcTable) != binary.BigEndian.Uint32(sum) {
+		return nil, errCorrupt
+	}
+
+	iv, sanity := data[:y.IVSize], data[y.IVSize:y.IVSize+len(sanityText)]
+	if !bytes.Equal(kr.decrypt(sanity, iv), sanityText) {
+		return nil, ErrEncryptionKeyMismatch
+	}
+	for data = data[y.IVSize+len(sanityText):]; len(data) > 0; {
+		if len(data) < dataKeyHeaderSize {
+			return nil, errCorrupt
+		}
+		id := binary.BigEndian.Uint64(data[0:8])
+		createdAt := time.Unix(0, int64(binary.BigEndian.Uint64(data[8:16])))
+		klen := int(binary.BigEndian.Uint32(data[16:20]))
+		iv := data[20:dataKeyHeaderSize]
+		data = data[dataKeyHeaderSize:]
+		if len(data) < klen {
+			return nil, errCorrupt
+		}
+		dk, err := y.NewDataKey(id, kr.decrypt(data[:klen], iv))
+		if err != nil {
+			return nil, err
+		}
+		data = data[klen:]
+		kr.keys[id] = dk
+		kr.createdAt[id] = createdAt
+		if id > kr.latest {
+			kr.latest = id
+		}
+	}
+	return kr, nil
+}
+
+// decrypt returns src decrypted with the encryption key, or src itself if there is none.
+func (kr *keyRegistry) decrypt(src, iv []byte) []byte {
+	if kr.masterKey == nil {
+		return src
+	}
+	dst := make([]byte, len(src))
+	kr.masterKey.XOR(dst, src, iv)
+	return dst
+}
+
+// DataKey returns the data key with the given id, so that tables can be decrypted with it.
+func (kr *keyRegistry) DataKey(id uint64) (*y.DataKey, error) {
+	kr.Lock()
+	defer kr.Unlock()
+	dk, ok := kr.keys[id]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownDataKey, "Data key: %d", id)
+	}
+	return dk, nil
+}
+
+// latestDataKey returns the data key to encrypt new data with, or nil if the DB isn't
+// encrypted. It generates a new data key if the latest one is due for rotation.
+func (kr *keyRegistry) latestDataKey() (*y.DataKey, error) {
+	if kr.masterKey == nil {
+		return nil, nil
+	}
+	kr.Lock()
+	defer kr.Unlock()
+	if dk, ok := kr.keys[kr.latest]; ok && time.Since(kr.createdAt[kr.latest]) < kr.rotation {
+		return dk, nil
+	}
+
+	key := make([]byte, len(kr.masterKey.Key))
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "While generating data key")
+	}
+	dk, err := y.NewDataKey(kr.latest+1, key)
+	if err != nil {
+		return nil, err
+	}
+	kr.keys[dk.ID] = dk
+	kr.createdAt[dk.ID] = time.Now()
+	prev := kr.latest
+	kr.latest = dk.ID
+	if err := kr.persist(); err != nil {
+		delete(kr.keys, dk.ID)
+		delete(kr.createdAt, dk.ID)
+		kr.latest = prev
+		return nil, err
+	}
+	return dk, nil
+}
+
+// encrypt appends src encrypted with the encryption key to buf, along with the IV it's
+// encrypted from. If there is no encryption key, src is appended as is.
+func (kr *keyRegistry) encrypt(buf *bytes.Buffer, src []byte) error {
+	iv := make([]byte, y.IVSize)
+	dst := src
+	if kr.masterKey != nil {
+		var err error
+		if iv, err = y.GenerateIV(); err != nil {
+			return err
+		}
+		dst = make([]byte, len(src))
+		kr.masterKey.XOR(dst, src, iv)
+	}
+	buf.Write(iv)
+	buf.Write(dst)
+	return nil
+}
+
+// persist writes out the registry to a new file, and renames it over the old one. Losing the
+// registry means losing the data, so the file and the dir are synced. kr must be locked, unless
+// it's being opened.
+func (kr *keyRegistry) persist() error {
+	ids := make([]uint64, 0, len(kr.keys))
+	for id := range kr.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var buf bytes.Buffer
+	if err := kr.encrypt(&buf, sanityText); err != nil {
+		return err
+	}
+	var hdr [20]byte
+	for _, id := range ids {
+		dk := kr.keys[id]
+		binary.BigEndian.PutUint64(hdr[0:8], id)
+		binary.BigEndian.PutUint64(hdr[8:16], uint64(kr.createdAt[id].UnixNano()))
+		binary.BigEndian.PutUint32(hdr[16:20], uint32(len(dk.Key)))
+		buf.Write(hdr[:])
+		if err := kr.encrypt(&buf, dk.Key); err != nil {
+			return err
+		}
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(buf.Bytes(), y.CastagnoliCrcTable))
+	buf.Write(sum[:])
+
+	rewritePath := filepath.Join(kr.dir, keyRegistryRewriteFilename)
+	fp, err := y.OpenTruncFile(rewritePath, true)
+	if err != nil {
+		return errors.Wrap(err, "While writing key registry")
+	}
+	if _, err := fp.Write(buf.Bytes()); err != nil {
+		fp.Close()
+		return errors.Wrap(err, "While writing key registry")
+	}
+	// In Windows the files should be closed before doing a Rename.
+	if err := fp.Close(); err != nil {
+		return errors.Wrap(err, "While writing key registry")
+	}
+	if err := os.Rename(rewritePath, filepath.Join(kr.dir, keyRegistryFilename)); err != nil {
+		return errors.Wrap(err, "While writing key registry")
+	}
+	return syncDir(kr.dir)
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key := []byte("0123456789abcdef")
+
+	kr, err := openKeyRegistry(dir, key, time.Hour)
+	require.NoError(t, err)
+	dk1, err := kr.latestDataKey()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), dk1.ID)
+	require.Equal(t, len(key), len(dk1.Key))
+	dk, err := kr.latestDataKey()
+	require.NoError(t, err)
+	require.Equal(t, dk1, dk)
+
+	// The data keys are stored encrypted.
+	buf, err := ioutil.ReadFile(filepath.Join(dir, keyRegistryFilename))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(buf, dk1.Key))
+	require.False(t, bytes.Contains(buf, sanityText))
+
+	// A data key which is due for rotation is replaced, and the old one kept.
+	kr, err = openKeyRegistry(dir, key, 0)
+	require.NoError(t, err)
+	dk2, err := kr.latestDataKey()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), dk2.ID)
+	require.NotEqual(t, dk1.Key, dk2.Key)
+
+	kr, err = openKeyRegistry(dir, key, time.Hour)
+	require.NoError(t, err)
+	dk, err = kr.DataKey(1)
+	require.NoError(t, err)
+	require.Equal(t, dk1.Key, dk.Key)
+	dk, err = kr.latestDataKey()
+	require.NoError(t, err)
+	require.Equal(t, dk2.Key, dk.Key)
+	_, err = kr.DataKey(3)
+	require.Equal(t, ErrUnknownDataKey, errors.Cause(err))
+
+	_, err = openKeyRegistry(dir, []byte("fedcba9876543210"), time.Hour)
+	require.Equal(t, ErrEncryptionKeyMismatch, err)
+	_, err = openKeyRegistry(dir, nil, time.Hour)
+	require.Equal(t, ErrEncryptionKeyMismatch, err)
+	_, err = openKeyRegistry(dir, []byte("short"), time.Hour)
+	require.Equal(t, ErrInvalidEncryptionKey, errors.Cause(err))
+}
+
+func TestEncryptedDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.EncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+	kv, err := Open(opts)
+	require.NoError(t, err)
+
+	for i := 0; i < 200; i++ {
+		txnSet(t, kv, []byte(fmt.Sprintf("secretkey%03d", i)),
+			[]byte(fmt.Sprintf("secretvalue%03d%064d", i, 0)), 0)
+		txnSet(t, kv, []byte(fmt.Sprintf("secretsmall%03d", i)), []byte("secretv"), 0)
+	}
+	flushAndCompact(t, kv)
+	report, err := kv.VerifyIntegrity(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, len(report.Corruptions))
+	require.Equal(t, 200, report.ValuePointers)
+	require.NoError(t, kv.Close())
+
+	// Nothing is written out in plaintext.
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, fi := range files {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(buf, []byte("secret")), "%s", fi.Name())
+	}
+
+	kv, err = Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		for i := 0; i < 200; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("secretkey%03d", i)))
+			require.NoError(t, err)
+			val, err := item.Value()
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("secretvalue%03d%064d", i, 0), string(val))
+		}
+		return nil
+	}))
+	require.Equal(t, 400, countKeys(t, kv, "secret"))
+	require.NoError(t, kv.Close())
+
+	// A data key can't be rotated on every write.
+	opts.EncryptionKeyRotationDuration = 0
+	_, err = Open(opts)
+	require.Equal(t, ErrInvalidEncryptionKeyRotation, err)
+	opts.EncryptionKeyRotationDuration = DefaultOptions.EncryptionKeyRotationDuration
+
+	opts.EncryptionKey = []byte("fedcba9876543210fedcba9876543210")
+	_, err = Open(opts)
+	require.Equal(t, ErrEncryptionKeyMismatch, err)
+	opts.EncryptionKey = nil
+	_, err = Open(opts)
+	require.Equal(t, ErrEncryptionKeyMismatch, err)
+}
@@ -100,50 +100,42 @@ func (s *levelHandler) deleteTables(toDel []*table.Table) error {
 	return decrRefs(toDel)
 }
 
-// replaceTables will replace tables[left:right] with newTables. Note this EXCLUDES tables[right].
-// You must call decr() to delete the old tables _after_ writing the update to the manifest.
-func (s *levelHandler) replaceTables(newTables []*table.Table) error {
-	// Need to re-search the range of tables in this level to be replaced as other goroutines might
-	// be changing it as well.  (They can't touch our tables, but if they add/remove other tables,
-	// the indices get shifted around.)
-	if len(newTables) == 0 {
-		return nil
-	}
-
+// replaceTables will replace tables in toDel with those in toAdd. It doesn't matter whether the
+// key ranges of the two sets line up, which lets compaction drop keys at the edges of its range.
+// Old tables are only DecrRef'd after the level has been updated.
+func (s *levelHandler) replaceTables(toDel, toAdd []*table.Table) error {
 	s.Lock() // We s.Unlock() below.
 
-	// Increase totalSize first.
-	for _, tbl := range newTables {
-		s.totalSize += tbl.Size()
-		tbl.IncrRef()
+	// Other goroutines might be changing the level as well, so look up the tables to be
+	// removed by ID instead of relying on their positions.
+	toDelMap := make(map[uint64]struct{})
+	for _, t := range toDel {
+		toDelMap[t.ID()] = struct{}{}
 	}
-
-	kr := keyRange{
-		left:  newTables[0].Smallest(),
-		right: newTables[len(newTables)-1].Biggest(),
+	var newTables []*table.Table
+	for _, t := range s.tables {
+		_, found := toDelMap[t.ID()]
+		if !found {
+			newTables = append(newTables, t)
+			continue
+		}
+		s.totalSize -= t.Size()
 	}
-	left, right := s.overlappingTables(levelHandlerRLocked{}, kr)
-
-	toDecr := make([]*table.Table, right-left)
-	// Update totalSize and reference counts.
-	for i := left; i < right; i++ {
-		tbl := s.tables[i]
-		s.totalSize -= tbl.Size()
-		toDecr[i-left] = tbl
+
+	// Increase totalSize first.
+	for _, t := range toAdd {
+		s.totalSize += t.Size()
+		t.IncrRef()
+		newTables = append(newTables, t)
 	}
 
-	// To be safe, just make a copy. TODO: Be more careful and avoid copying.
-	numDeleted := right - left
-	numAdded := len(newTables)
-	tables := make([]*table.Table, len(s.tables)-numDeleted+numAdded)
-	y.AssertTrue(left == copy(tables, s.tables[:left]))
-	t := tables[left:]
-	y.AssertTrue(numAdded == copy(t, newTables))
-	t = t[numAdded:]
-	y.AssertTrue(len(s.tables[right:]) == copy(t, s.tables[right:]))
-	s.tables = tables
+	// Assign tables.
+	s.tables = newTables
+	sort.Slice(s.tables, func(i, j int) bool {
+		return y.CompareKeys(s.tables[i].Smallest(), s.tables[j].Smallest()) < 0
+	})
 	s.Unlock() // s.Unlock before we DecrRef tables -- that can be slow.
-	return decrRefs(toDecr)
+	return decrRefs(toDel)
 }
 
 func decrRefs(tables []*table.Table) error {
@@ -251,6 +243,10 @@ func (s *levelHandler) get(key []byte) (y.ValueStruct, error) {
 		y.NumLSMGets.Add(s.strLevel, 1)
 		it.Seek(key)
 		if !it.Valid() {
+			if err := it.Error(); err != nil {
+				_ = decr()
+				return y.ValueStruct{}, errors.Wrapf(err, "While reading table: %d", th.ID())
+			}
 			continue
 		}
 		if y.SameKey(key, it.Key()) {
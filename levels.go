@@ -17,11 +17,13 @@
 package badger
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/trace"
@@ -115,7 +117,8 @@ func newLevelsController(kv *DB, mf *Manifest) (*levelsController, error) {
 			return nil, errors.Wrapf(err, "Opening file: %q", fname)
 		}
 
-		t, err := table.OpenTable(fd, kv.opt.TableLoadingMode)
+		t, err := table.OpenTable(fd, kv.opt.TableLoadingMode, kv.opt.ChecksumVerificationMode,
+			kv.blockCache, kv.registry)
 		if err != nil {
 			closeAllTables(tables)
 			return nil, errors.Wrapf(err, "Opening table: %q", fname)
@@ -194,9 +197,19 @@ func (s *levelsController) runWorker(lc *y.Closer) {
 		case <-ticker.C:
 			prios := s.pickCompactLevels()
 			for _, p := range prios {
-				// TODO: Handle error.
-				didCompact, _ := s.doCompact(p)
+				didCompact, err := s.doCompact(p)
+				if err != nil {
+					s.kv.health.failed(taskCompaction, err)
+					// Back off before the next attempt.
+					select {
+					case <-time.After(s.kv.health.backoff(taskCompaction)):
+					case <-lc.HasBeenClosed():
+						return
+					}
+					break
+				}
 				if didCompact {
+					s.kv.health.succeeded(taskCompaction)
 					break
 				}
 			}
@@ -220,8 +233,10 @@ func (l *levelHandler) isCompactable(delSize int64) bool {
 }
 
 type compactionPriority struct {
-	level int
-	score float64
+	level      int
+	score      float64
+	dropPrefix []byte
+	manual     *userRange // Only compact the tables in this range, whatever the level's size.
 }
 
 // pickCompactLevel determines which level to compact.
@@ -257,17 +272,153 @@ func (s *levelsController) pickCompactLevels() (prios []compactionPriority) {
 	return prios
 }
 
-// compactBuildTables merge topTables and botTables to form a list of new tables.
+// checkOverlap checks if the given tables overlap with any level from the given "lev" onwards.
+func (s *levelsController) checkOverlap(tables []*table.Table, lev int) bool {
+	kr := getKeyRange(tables)
+	for i, lh := range s.levels {
+		if i < lev { // Skip upper levels.
+			continue
+		}
+		lh.RLock()
+		left, right := lh.overlappingTables(levelHandlerRLocked{}, kr)
+		lh.RUnlock()
+		if right-left > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Compactions with enough bottom tables are split into up to this many subcompactions, which run
+// concurrently.
+const maxSubcompactions = 4
+
+// Each subcompaction covers at least this many times MaxTableSize of bottom tables, so that the
+// small compactions aren't split into goroutines writing out fragments of tables.
+const minSubcompactionTables = 2
+
+// subcompactionSplits returns the user keys the compaction is split at. Each subcompaction covers
+// the keys after the previous split, up to and including the next one. The splits are the biggest
+// keys of bottom tables, picked so that the subcompactions cover about as many of them. All the
+// versions of a key fall into the same subcompaction.
+func (s *levelsController) subcompactionSplits(cd compactDef) [][]byte {
+	var size int64
+	for _, t := range cd.bot {
+		size += t.Size()
+	}
+	n := int(size / (minSubcompactionTables * s.kv.opt.MaxTableSize))
+	if n > len(cd.bot) {
+		n = len(cd.bot)
+	}
+	if n > maxSubcompactions {
+		n = maxSubcompactions
+	}
+	var splits [][]byte
+	for i := 1; i < n; i++ {
+		key := y.ParseKey(cd.bot[i*len(cd.bot)/n-1].Biggest())
+		if len(splits) > 0 && bytes.Compare(key, splits[len(splits)-1]) <= 0 {
+			continue
+		}
+		splits = append(splits, key)
+	}
+	return splits
+}
+
+// compactBuildTables merge topTables and botTables to form a list of new tables. It also returns
+// the number of bytes of each value log file which the dropped entries pointed to.
 func (s *levelsController) compactBuildTables(
-	l int, cd compactDef) ([]*table.Table, func() error, error) {
+	l int, cd compactDef) ([]*table.Table, map[uint32]int64, func() error, error) {
 	topTables := cd.top
 	botTables := cd.bot
 
+	// No reader can see a version at or below discardTs, unless it's the latest version of its
+	// key at or below discardTs. So, only the NumVersionsToKeep latest of those versions are kept,
+	// and none of the versions shadowed by a deletion or an expired entry.
+	discardTs := s.kv.orc.discardAtOrBelow()
+
+	// Deletions and expired entries can only be dropped themselves if no lower level holds an
+	// older version of the same key, which could otherwise resurface.
+	hasOverlap := s.checkOverlap(append(append([]*table.Table{}, topTables...), botTables...),
+		cd.nextLevel.level+1)
+
+	splits := s.subcompactionSplits(cd)
+	results := make([][]*table.Table, len(splits)+1)
+	discards := make([]map[uint32]int64, len(splits)+1)
+	errs := make([]error, len(splits)+1)
+	var wg sync.WaitGroup
+	for i := range results {
+		var after, upTo []byte
+		if i > 0 {
+			after = splits[i-1]
+		}
+		if i < len(splits) {
+			upTo = splits[i]
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], discards[i], errs[i] =
+				s.subcompact(l, cd, after, upTo, discardTs, hasOverlap)
+		}(i)
+	}
+	wg.Wait()
+	if len(splits) > 0 {
+		cd.elog.LazyPrintf("LOG Compact. Ran %d subcompactions\n", len(splits)+1)
+	}
+
+	var newTables []*table.Table
+	discarded := make(map[uint32]int64)
+	var firstErr error
+	for i := range results {
+		newTables = append(newTables, results[i]...)
+		for fid, n := range discards[i] {
+			discarded[fid] += n
+		}
+		if firstErr == nil {
+			firstErr = errs[i]
+		}
+	}
+	if firstErr == nil {
+		// Ensure created files' directory entries are visible.  We don't mind the extra latency
+		// from not doing this ASAP after all file creation has finished because this is a
+		// background operation.
+		firstErr = syncDir(s.kv.opt.Dir)
+	}
+
+	if firstErr != nil {
+		// An error happened.  Delete all the newly created table files (by calling DecrRef
+		// -- we're the only holders of a ref).
+		for _, t := range newTables {
+			t.DecrRef()
+		}
+		errorReturn := errors.Wrapf(firstErr, "While running compaction for: %+v", cd)
+		return nil, nil, nil, errorReturn
+	}
+
+	sort.Slice(newTables, func(i, j int) bool {
+		return y.CompareKeys(newTables[i].Biggest(), newTables[j].Biggest()) < 0
+	})
+
+	return newTables, discarded, func() error { return decrRefs(newTables) }, nil
+}
+
+// subcompact builds the new tables for the keys of the compaction after the user key after, up to
+// and including upTo. A nil key leaves that end open. On error, the tables built so far are
+// returned too, to be cleaned up.
+func (s *levelsController) subcompact(l int, cd compactDef, after, upTo []byte,
+	discardTs uint64, hasOverlap bool) ([]*table.Table, map[uint32]int64, error) {
+	topTables := cd.top
+	botTables := cd.bot
+	dk, err := s.kv.registry.latestDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Create iterators across all the tables involved first.
 	var iters []y.Iterator
 	if l == 0 {
 		iters = appendIteratorsReversed(iters, topTables, false)
-	} else {
+	} else if len(topTables) > 0 {
 		y.AssertTrue(len(topTables) == 1)
 		iters = []y.Iterator{topTables[0].NewIterator(false)}
 	}
@@ -277,7 +428,25 @@ func (s *levelsController) compactBuildTables(
 	it := y.NewMergeIterator(iters, false)
 	defer it.Close() // Important to close the iterator to do ref counting.
 
-	it.Rewind()
+	if after == nil {
+		it.Rewind()
+	} else {
+		// Version 0 of a key sorts after all its other versions.
+		it.Seek(y.KeyWithTs(after, 0))
+		for it.Valid() && bytes.Equal(y.ParseKey(it.Key()), after) {
+			it.Next()
+		}
+	}
+	valid := func() bool {
+		return it.Valid() && (upTo == nil || bytes.Compare(y.ParseKey(it.Key()), upTo) <= 0)
+	}
+
+	var lastKey, skipKey []byte
+	var numVersions int
+
+	// The values of the dropped entries, which live in the value log, are now garbage there.
+	discarded := make(map[uint32]int64)
+	discard := func(vs y.ValueStruct) { addDiscard(discarded, vs) }
 
 	// Start generating new tables.
 	type newTableResult struct {
@@ -286,18 +455,57 @@ func (s *levelsController) compactBuildTables(
 	}
 	resultCh := make(chan newTableResult)
 	var i int
-	for ; it.Valid(); i++ {
+	var firstErr error
+	for valid() && firstErr == nil {
 		timeStart := time.Now()
-		builder := table.NewTableBuilder()
-		for ; it.Valid(); it.Next() {
+		builder := table.NewTableBuilder(s.kv.opt.Compression, s.kv.opt.BloomFalsePositive, dk)
+		for ; valid(); it.Next() {
 			if builder.ReachedCapacity(s.kv.opt.MaxTableSize) {
 				break
 			}
-			y.Check(builder.Add(it.Key(), it.Value()))
+			key, vs := it.Key(), it.Value()
+			if len(cd.dropPrefix) > 0 && !bytes.HasPrefix(key, badgerPrefix) &&
+				bytes.HasPrefix(y.ParseKey(key), cd.dropPrefix) {
+				discard(vs)
+				continue
+			}
+			if len(skipKey) > 0 {
+				if y.SameKey(key, skipKey) {
+					discard(vs)
+					continue
+				}
+				skipKey = skipKey[:0]
+			}
+			if !y.SameKey(key, lastKey) {
+				lastKey = y.Safecopy(lastKey, key)
+				numVersions = 0
+			}
+			if y.ParseTs(key) <= discardTs {
+				numVersions++
+				deleted := isDeletedOrExpired(vs.Meta, vs.ExpiresAt)
+				if deleted || numVersions >= s.kv.opt.NumVersionsToKeep {
+					// The older versions of this key are invisible to every reader.
+					skipKey = y.Safecopy(skipKey, key)
+				}
+				if deleted && !hasOverlap {
+					discard(vs)
+					continue
+				}
+			}
+			if err := builder.Add(key, vs); err != nil {
+				firstErr = err
+				break
+			}
+		}
+		if firstErr != nil {
+			builder.Close()
+			break
+		}
+		if builder.Empty() {
+			// Every entry picked up in this iteration was dropped.
+			builder.Close()
+			continue
 		}
-		// It was true that it.Valid() at least once in the loop above, which means we
-		// called Add() at least once, and builder is not Empty().
-		y.AssertTrue(!builder.Empty())
 
 		cd.elog.LazyPrintf("LOG Compact. Iteration to generate one table took: %v\n", time.Since(timeStart))
 
@@ -305,59 +513,54 @@ func (s *levelsController) compactBuildTables(
 		go func(builder *table.Builder) {
 			defer builder.Close()
 
+			data, err := builder.Finish()
+			if err != nil {
+				resultCh <- newTableResult{nil, errors.Wrapf(err, "While building table: %d", fileID)}
+				return
+			}
 			fd, err := y.CreateSyncedFile(table.NewFilename(fileID, s.kv.opt.Dir), true)
 			if err != nil {
 				resultCh <- newTableResult{nil, errors.Wrapf(err, "While opening new table: %d", fileID)}
 				return
 			}
 
-			if _, err := fd.Write(builder.Finish()); err != nil {
+			if _, err := s.kv.compactionLimiter.Writer(fd).Write(data); err != nil {
 				resultCh <- newTableResult{nil, errors.Wrapf(err, "Unable to write to file: %d", fileID)}
 				return
 			}
 
-			tbl, err := table.OpenTable(fd, s.kv.opt.TableLoadingMode)
+			tbl, err := table.OpenTable(fd, s.kv.opt.TableLoadingMode,
+				s.kv.opt.ChecksumVerificationMode, s.kv.blockCache, s.kv.registry)
 			// decrRef is added below.
 			resultCh <- newTableResult{tbl, errors.Wrapf(err, "Unable to open table: %q", fd.Name())}
 		}(builder)
+		i++
 	}
 
-	newTables := make([]*table.Table, 0, 20)
+	newTables := make([]*table.Table, 0, i)
 
 	// Wait for all table builders to finish.
-	var firstErr error
 	for x := 0; x < i; x++ {
 		res := <-resultCh
-		newTables = append(newTables, res.table)
+		if res.table != nil {
+			newTables = append(newTables, res.table)
+		}
 		if firstErr == nil {
 			firstErr = res.err
 		}
 	}
 
 	if firstErr == nil {
-		// Ensure created files' directory entries are visible.  We don't mind the extra latency
-		// from not doing this ASAP after all file creation has finished because this is a
-		// background operation.
-		firstErr = syncDir(s.kv.opt.Dir)
-	}
-
-	if firstErr != nil {
-		// An error happened.  Delete all the newly created table files (by calling DecrRef
-		// -- we're the only holders of a ref).
-		for j := 0; j < i; j++ {
-			if newTables[j] != nil {
-				newTables[j].DecrRef()
+		// A table iterator stops at a block it can't read, like one failing its checksum. The
+		// merge iterator would carry on without it, so check that none of them did.
+		for _, it := range iters {
+			if err := it.(interface{ Error() error }).Error(); err != nil {
+				firstErr = err
+				break
 			}
 		}
-		errorReturn := errors.Wrapf(firstErr, "While running compaction for: %+v", cd)
-		return nil, nil, errorReturn
 	}
-
-	sort.Slice(newTables, func(i, j int) bool {
-		return y.CompareKeys(newTables[i].Biggest(), newTables[j].Biggest()) < 0
-	})
-
-	return newTables, func() error { return decrRefs(newTables) }, nil
+	return newTables, discarded, firstErr
 }
 
 func buildChangeSet(cd *compactDef, newTables []*table.Table) protos.ManifestChangeSet {
@@ -387,6 +590,9 @@ type compactDef struct {
 	nextRange keyRange
 
 	thisSize int64
+
+	dropPrefix []byte     // Keys with this prefix are dropped, instead of being compacted.
+	manual     *userRange // Set for the compactions run by CompactRange and Flatten.
 }
 
 func (cd *compactDef) lockLevels() {
@@ -408,6 +614,17 @@ func (s *levelsController) fillTablesL0(cd *compactDef) bool {
 	if len(cd.top) == 0 {
 		return false
 	}
+	if cd.manual != nil {
+		// Level 0 tables overlap each other, so they're compacted together, as long as any of
+		// them is in the range.
+		var found bool
+		for _, t := range cd.top {
+			found = found || cd.manual.overlaps(t)
+		}
+		if !found {
+			return false
+		}
+	}
 	cd.thisRange = infRange
 
 	kr := getKeyRange(cd.top)
@@ -445,6 +662,9 @@ func (s *levelsController) fillTables(cd *compactDef) bool {
 	})
 
 	for _, t := range tbls {
+		if cd.manual != nil && !cd.manual.overlaps(t) {
+			continue
+		}
 		cd.thisSize = t.Size()
 		cd.thisRange = keyRange{
 			left:  t.Smallest(),
@@ -510,7 +730,7 @@ func (s *levelsController) runCompactDef(l int, cd compactDef) (err error) {
 		// read, or at least acquire s.RLock(), in increasing order by level, so that we don't skip
 		// a compaction.
 
-		if err := nextLevel.replaceTables(cd.top); err != nil {
+		if err := nextLevel.replaceTables([]*table.Table{}, cd.top); err != nil {
 			return err
 		}
 		if err := thisLevel.deleteTables(cd.top); err != nil {
@@ -522,7 +742,7 @@ func (s *levelsController) runCompactDef(l int, cd compactDef) (err error) {
 		return nil
 	}
 
-	newTables, decr, err := s.compactBuildTables(l, cd)
+	newTables, discarded, decr, err := s.compactBuildTables(l, cd)
 	if err != nil {
 		return err
 	}
@@ -541,12 +761,16 @@ func (s *levelsController) runCompactDef(l int, cd compactDef) (err error) {
 
 	// See comment earlier in this function about the ordering of these ops, and the order in which
 	// we access levels when reading.
-	if err := nextLevel.replaceTables(newTables); err != nil {
+	if err := nextLevel.replaceTables(cd.bot, newTables); err != nil {
 		return err
 	}
 	if err := thisLevel.deleteTables(cd.top); err != nil {
 		return err
 	}
+	if err := s.kv.vlog.discardStats.add(discarded); err != nil {
+		// The stats are only a hint for value log GC, so the compaction still counts as done.
+		s.kv.elog.Errorf("While updating discard stats: %v", err)
+	}
 
 	// Note: For level 0, while doCompact is running, it is possible that new tables are added.
 	// However, the tables are added only to the end, so it is ok to just delete the first table.
@@ -562,9 +786,11 @@ func (s *levelsController) doCompact(p compactionPriority) (bool, error) {
 	y.AssertTrue(l+1 < s.kv.opt.MaxLevels) // Sanity check.
 
 	cd := compactDef{
-		elog:      trace.New("Badger", "Compact"),
-		thisLevel: s.levels[l],
-		nextLevel: s.levels[l+1],
+		elog:       trace.New("Badger", "Compact"),
+		thisLevel:  s.levels[l],
+		nextLevel:  s.levels[l+1],
+		dropPrefix: p.dropPrefix,
+		manual:     p.manual,
 	}
 	cd.elog.SetMaxEvents(100)
 	defer cd.elog.Finish()
@@ -588,19 +814,81 @@ func (s *levelsController) doCompact(p compactionPriority) (bool, error) {
 
 	cd.elog.LazyPrintf("Running for level: %d\n", cd.thisLevel.level)
 	s.cstatus.toLog(cd.elog)
-	if err := s.runCompactDef(l, cd); err != nil {
+	err := s.runCompactDef(l, cd)
+	// Done with compaction. So, remove the ranges from compaction status, even if it failed, so
+	// that the tables can be compacted again.
+	s.cstatus.delete(cd)
+	if err != nil {
 		// This compaction couldn't be done successfully.
 		cd.elog.LazyPrintf("\tLOG Compact FAILED with error: %+v: %+v", err, cd)
 		return false, err
 	}
-
-	// Done with compaction. So, remove the ranges from compaction status.
-	s.cstatus.delete(cd)
 	s.cstatus.toLog(cd.elog)
 	cd.elog.LazyPrintf("Compaction for level: %d DONE", cd.thisLevel.level)
 	return true, nil
 }
 
+// compactManually compacts the tables on level l which hold keys in r into level l+1, running up
+// to workers compactions at a time. Compactions already running on these tables are waited for.
+// It returns once none of the tables that were there to begin with are left on level l, or on the
+// first error.
+func (s *levelsController) compactManually(l int, r userRange, workers int) error {
+	lh := s.levels[l]
+	ids := make(map[uint64]struct{})
+	lh.RLock()
+	for _, t := range lh.tables {
+		if r.overlaps(t) {
+			ids[t.ID()] = struct{}{}
+		}
+	}
+	lh.RUnlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	pending := func() bool {
+		lh.RLock()
+		defer lh.RUnlock()
+		for _, t := range lh.tables {
+			if _, ok := ids[t.ID()]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if l == 0 {
+		// Level 0 is compacted as a whole.
+		workers = 1
+	}
+	var failed int32
+	errCh := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for atomic.LoadInt32(&failed) == 0 && pending() {
+				didCompact, err := s.doCompact(compactionPriority{level: l, manual: &r})
+				if err != nil {
+					atomic.StoreInt32(&failed, 1)
+					errCh <- err
+					return
+				}
+				if !didCompact {
+					// The tables left are being compacted by another worker, or in the
+					// background.
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			errCh <- nil
+		}()
+	}
+	var firstErr error
+	for i := 0; i < workers; i++ {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 func (s *levelsController) addLevel0Table(t *table.Table) error {
 	// We update the manifest _before_ the table becomes part of a levelHandler, because at that
 	// point it could get used in some compaction.  This ensures the manifest file gets updated in
@@ -650,6 +938,160 @@ func (s *levelsController) addLevel0Table(t *table.Table) error {
 	return nil
 }
 
+// dropTree deletes all the tables from all the levels. It returns the number of tables deleted.
+// Compactions must be stopped.
+func (s *levelsController) dropTree() (int, error) {
+	var all []*table.Table
+	for _, l := range s.levels {
+		l.RLock()
+		all = append(all, l.tables...)
+		l.RUnlock()
+	}
+	if len(all) == 0 {
+		return 0, nil
+	}
+
+	// Generate the manifest changes.
+	changes := []*protos.ManifestChange{}
+	for _, table := range all {
+		changes = append(changes, makeTableDeleteChange(table.ID()))
+	}
+	if err := s.kv.manifest.addChanges(changes); err != nil {
+		return 0, err
+	}
+
+	// Now that manifest has been successfully written, we can delete the tables.
+	for _, l := range s.levels {
+		l.RLock()
+		tables := make([]*table.Table, len(l.tables))
+		copy(tables, l.tables)
+		l.RUnlock()
+		if err := l.deleteTables(tables); err != nil {
+			return 0, err
+		}
+	}
+	return len(all), nil
+}
+
+// dropPrefix removes all the keys with the given prefix from the levels. Tables which only hold
+// keys with the prefix are deleted outright. Tables which also hold other keys are rewritten
+// without the prefixed ones: level 0 is compacted into level 1, and the tables on the other
+// levels are compacted into the same level. Internal badger keys are never dropped. Compactions
+// must be stopped.
+func (s *levelsController) dropPrefix(prefix []byte) error {
+	// If internal keys could have the prefix, tables are always rewritten to keep those.
+	internal := bytes.HasPrefix(badgerPrefix, prefix) || bytes.HasPrefix(prefix, badgerPrefix)
+	for _, l := range s.levels {
+		var toDel, toRewrite []*table.Table
+		l.RLock()
+		for _, t := range l.tables {
+			smallest, biggest := y.ParseKey(t.Smallest()), y.ParseKey(t.Biggest())
+			switch {
+			case !internal && bytes.HasPrefix(smallest, prefix) && bytes.HasPrefix(biggest, prefix):
+				toDel = append(toDel, t)
+			case bytes.Compare(biggest, prefix) < 0:
+				// All keys sort before the prefix.
+			case bytes.Compare(smallest, prefix) > 0 && !bytes.HasPrefix(smallest, prefix):
+				// All keys sort after the prefix.
+			default:
+				toRewrite = append(toRewrite, t)
+			}
+		}
+		l.RUnlock()
+
+		if len(toDel) > 0 {
+			// All the values the deleted tables point to become garbage in the value log.
+			discarded := make(map[uint32]int64)
+			changes := []*protos.ManifestChange{}
+			for _, table := range toDel {
+				if err := tableDiscards(discarded, table); err != nil {
+					return err
+				}
+				changes = append(changes, makeTableDeleteChange(table.ID()))
+			}
+			if err := s.kv.manifest.addChanges(changes); err != nil {
+				return err
+			}
+			if err := l.deleteTables(toDel); err != nil {
+				return err
+			}
+			if err := s.kv.vlog.discardStats.add(discarded); err != nil {
+				// As in runCompactDef, the stats are only a hint for value log GC.
+				s.kv.elog.Errorf("While updating discard stats: %v", err)
+			}
+		}
+		if len(toRewrite) == 0 {
+			continue
+		}
+
+		if l.level == 0 {
+			// Level 0 tables overlap each other, so they can only be rewritten together. That
+			// has to wait for any manual compaction holding them, or level 1, to be done. Once
+			// they've left level 0, what's left of the prefix is dropped from the next level.
+			p := compactionPriority{level: 0, dropPrefix: prefix}
+			for s.hasTables(l, toRewrite) {
+				didCompact, err := s.doCompact(p)
+				if err != nil {
+					return err
+				}
+				if !didCompact {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			continue
+		}
+		for _, t := range toRewrite {
+			cd := compactDef{
+				elog:       trace.New("Badger", "DropPrefix"),
+				thisLevel:  l,
+				nextLevel:  l,
+				bot:        []*table.Table{t},
+				dropPrefix: prefix,
+			}
+			err := s.runCompactDef(l.level, cd)
+			cd.elog.Finish()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addDiscard counts the value vs points to in the value log, if any, in discarded by fid.
+func addDiscard(discarded map[uint32]int64, vs y.ValueStruct) {
+	if vs.Meta&bitValuePointer == 0 {
+		return
+	}
+	var vp valuePointer
+	vp.Decode(vs.Value)
+	discarded[vp.Fid] += int64(vp.Len)
+}
+
+// tableDiscards counts the values all the entries of t point to in discarded, by fid.
+func tableDiscards(discarded map[uint32]int64, t *table.Table) error {
+	it := t.NewIterator(false)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		addDiscard(discarded, it.Value())
+	}
+	return it.Error()
+}
+
+// hasTables returns true if any of tables is still on level l.
+func (s *levelsController) hasTables(l *levelHandler, tables []*table.Table) bool {
+	l.RLock()
+	defer l.RUnlock()
+	for _, t := range l.tables {
+		for _, other := range tables {
+			if t == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (s *levelsController) close() error {
 	err := s.cleanupLevels()
 	return errors.Wrap(err, "levelsController.Close")
@@ -690,6 +1132,21 @@ func appendIteratorsReversed(out []y.Iterator, th []*table.Table, reversed bool)
 	return out
 }
 
+// refTables returns all the tables of the LSM tree, level by level. It obtains references for
+// them, to be released with decrRefs.
+func (s *levelsController) refTables() []*table.Table {
+	var tables []*table.Table
+	for _, level := range s.levels {
+		level.RLock()
+		for _, t := range level.tables {
+			t.IncrRef()
+			tables = append(tables, t)
+		}
+		level.RUnlock()
+	}
+	return tables
+}
+
 // appendIterators appends iterators to an array of iterators, for merging.
 // Note: This obtains references for the table handlers. Remember to close these iterators.
 func (s *levelsController) appendIterators(
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// MergeOperator represents a Badger merge operator. It collects the values added to a key via
+// Add, and periodically merges them into the value stored in Badger, using a user-provided
+// MergeFunc. This avoids the conflicts a read-modify-write transaction per update would run into.
+type MergeOperator struct {
+	f      MergeFunc
+	db     *DB
+	key    []byte
+	closer *y.Closer
+
+	// Held while the operands taken out by a merge are written, so that the stored value and the
+	// pending operands are read in step.
+	mergeLock sync.RWMutex
+
+	mu       sync.Mutex // Guards operands and stopped, never across a write.
+	operands [][]byte   // Values added, but not yet merged into the stored value.
+	stopped  bool
+}
+
+// MergeFunc accepts two byte slices, one representing an existing value, and another representing
+// a new value that needs to be 'merged' into it. MergeFunc contains the logic to perform the
+// 'merge' and return an updated value. It must not modify or retain either of its arguments.
+//
+// MergeFunc could perform operations like integer addition, list appends etc.
+type MergeFunc func(existing, val []byte) []byte
+
+// GetMergeOperator creates a new MergeOperator for a given key and returns a pointer to it. It
+// also fires off a goroutine that merges the added values into the stored value every dur.
+//
+// Stop must be called once the MergeOperator is no longer needed, to merge any pending values.
+func (db *DB) GetMergeOperator(key []byte, f MergeFunc, dur time.Duration) *MergeOperator {
+	op := &MergeOperator{
+		f:      f,
+		db:     db,
+		key:    key,
+		closer: y.NewCloser(1),
+	}
+
+	go op.runMerges(dur)
+	return op
+}
+
+// merge folds the operands into existing, which is nil if the key has no value yet.
+func (op *MergeOperator) merge(existing []byte, operands [][]byte) []byte {
+	val := existing
+	for _, o := range operands {
+		if val == nil {
+			val = o
+			continue
+		}
+		val = op.f(val, o)
+	}
+	return val
+}
+
+// storedValue returns a copy of the value stored for the key as seen by txn, or nil if there's
+// none.
+func (op *MergeOperator) storedValue(txn *Txn) ([]byte, error) {
+	item, err := txn.Get(op.key)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	val, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+	return y.Safecopy(nil, val), nil
+}
+
+// mergeAndWrite merges the pending operands into the stored value, and writes the result back.
+// The values added meanwhile are left for the next merge.
+func (op *MergeOperator) mergeAndWrite() error {
+	op.mergeLock.Lock()
+	defer op.mergeLock.Unlock()
+	op.mu.Lock()
+	operands := op.operands
+	op.operands = nil
+	op.mu.Unlock()
+	if len(operands) == 0 {
+		return nil
+	}
+
+	for {
+		err := op.db.Update(func(txn *Txn) error {
+			existing, err := op.storedValue(txn)
+			if err != nil {
+				return err
+			}
+			return txn.Set(op.key, op.merge(existing, operands), 0)
+		})
+		if err == ErrConflict {
+			// Someone else wrote to the key in the meantime. Merge into their value instead.
+			continue
+		}
+		if err != nil {
+			// Keep the operands for the next merge, ahead of the ones added meanwhile.
+			op.mu.Lock()
+			op.operands = append(operands, op.operands...)
+			op.mu.Unlock()
+			return err
+		}
+		return nil
+	}
+}
+
+func (op *MergeOperator) runMerges(dur time.Duration) {
+	ticker := time.NewTicker(dur)
+	defer op.closer.Done()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-op.closer.HasBeenClosed():
+			if err := op.mergeAndWrite(); err != nil {
+				op.db.elog.Errorf("failure in MergeOperator: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := op.mergeAndWrite(); err != nil {
+				op.db.elog.Errorf("failure in MergeOperator: %v", err)
+			}
+		}
+	}
+}
+
+// Add records a value in Badger which will eventually be merged by a background routine into the
+// values that were recorded by previous invocations to Add(). The value must not be modified by
+// the caller afterwards. It returns ErrMergeOperatorStopped once Stop has been called.
+func (op *MergeOperator) Add(val []byte) error {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if op.stopped {
+		return ErrMergeOperatorStopped
+	}
+	op.operands = append(op.operands, val)
+	return nil
+}
+
+// Get returns the latest value for the merge operator, which is derived by applying the merge
+// function to the stored value and all the values added since the last merge.
+func (op *MergeOperator) Get() ([]byte, error) {
+	op.mergeLock.RLock()
+	defer op.mergeLock.RUnlock()
+	var existing []byte
+	err := op.db.View(func(txn *Txn) (err error) {
+		existing, err = op.storedValue(txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Add only ever appends, so the operands seen here stay as they are once unlocked.
+	op.mu.Lock()
+	operands := op.operands
+	op.mu.Unlock()
+	val := op.merge(existing, operands)
+	if val == nil {
+		return nil, ErrKeyNotFound
+	}
+	return val, nil
+}
+
+// Stop waits for any pending merge to complete, merges the values added since, and then stops
+// the background goroutine. The values added after Stop is called are rejected.
+func (op *MergeOperator) Stop() {
+	op.mu.Lock()
+	op.stopped = true
+	op.mu.Unlock()
+	op.closer.SignalAndWait()
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func uint64ToBytes(i uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], i)
+	return buf[:]
+}
+
+func bytesToUint64(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+// Merge function to add two uint64 numbers
+func add(existing, new []byte) []byte {
+	return uint64ToBytes(bytesToUint64(existing) + bytesToUint64(new))
+}
+
+func TestMergeOperatorGetBeforeAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	m := kv.GetMergeOperator([]byte("merge"), add, 200*time.Millisecond)
+	defer m.Stop()
+
+	_, err = m.Get()
+	require.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestMergeOperator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	key := []byte("merge")
+	m := kv.GetMergeOperator(key, add, 10*time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				require.NoError(t, m.Add(uint64ToBytes(1)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Get sees the operands, whether or not they've been merged yet.
+	res, err := m.Get()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), bytesToUint64(res))
+
+	require.NoError(t, m.Add(uint64ToBytes(5)))
+	m.Stop()
+	require.Equal(t, ErrMergeOperatorStopped, m.Add(uint64ToBytes(7)))
+
+	// Stop merges everything that was added into the stored value.
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		item, err := txn.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1005), bytesToUint64(getItemValue(t, item)))
+		return nil
+	}))
+}
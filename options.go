@@ -17,6 +17,8 @@
 package badger
 
 import (
+	"time"
+
 	"github.com/dgraph-io/badger/options"
 )
 
@@ -73,6 +75,61 @@ type Options struct {
 	// Number of compaction workers to run concurrently.
 	NumCompactors int
 
+	// How to compress the blocks of the LSM tables written from now on.
+	// The algorithm is recorded in each block, so this can be changed
+	// for an existing DB. Compactions rewrite the older blocks gradually.
+	Compression options.CompressionType
+
+	// When to verify the checksums of the blocks of the LSM tables. A
+	// mismatch is reported as table.ErrChecksumMismatch.
+	ChecksumVerificationMode options.ChecksumVerificationMode
+
+	// Size of the cache of LSM table blocks, in bytes, shared by all the
+	// tables. It saves on the reads from disk with FileIO, and on the
+	// decompression of blocks. Set it to 0 to disable the cache.
+	BlockCacheSize int64
+
+	// The false positive rate of the bloom filters of the LSM tables. A
+	// lower rate saves on reads of the tables that don't hold a key, and
+	// takes more memory. Must be in (0, 1).
+	BloomFalsePositive float64
+
+	// Number of versions of each key to keep, among the versions no
+	// transaction reads at a later timestamp anymore. Compactions drop
+	// the older ones. Must be at least 1.
+	NumVersionsToKeep int
+
+	// Number of bytes per second the compactions, memtable flushes and
+	// value log rewrites may write, to leave room for the foreground IO.
+	// The limit is raised as level 0 fills up, so that writes don't stall.
+	// Set it to 0 for no limit. See DB.SetCompactionBytesPerSec.
+	CompactionBytesPerSec int64
+
+	// Number of bytes per second DB.VerifyIntegrity may read, so that it
+	// can run alongside the foreground IO. Set it to 0 for no limit.
+	VerifyBytesPerSec int64
+
+	// Called once with the error of a background task which kept
+	// failing, when the DB goes read-only. See DB.BackgroundError.
+	OnBackgroundError func(err error)
+
+	// Truncate the end of the value log on Open, if it's corrupt or
+	// holds an incomplete transaction, as a crash might leave it. The
+	// transactions dropped were never acknowledged as committed. If
+	// this isn't set, Open returns ErrTruncateNeeded instead.
+	Truncate bool
+
+	// AES key, 16, 24 or 32 bytes long, to encrypt the tables and value
+	// log with. The data is encrypted with data keys, which are kept in
+	// the key registry file in Dir, encrypted with this key. Leave it
+	// empty for no encryption. A DB must always be opened with the key
+	// it was created with, or Open returns ErrEncryptionKeyMismatch.
+	EncryptionKey []byte
+
+	// How long a data key is used for, before a new one is generated.
+	// Must be greater than zero if EncryptionKey is set.
+	EncryptionKeyRotationDuration time.Duration
+
 	// Transaction start and commit timestamps are managed by end-user.
 	ManagedTxns bool
 
@@ -87,10 +144,13 @@ type Options struct {
 // DefaultOptions sets a list of recommended options for good performance.
 // Feel free to modify these to suit your needs.
 var DefaultOptions = Options{
+	BlockCacheSize:      256 << 20,
+	BloomFalsePositive:  0.01,
 	DoNotCompact:        false,
 	LevelOneSize:        256 << 20,
 	LevelSizeMultiplier: 10,
 	TableLoadingMode:    options.LoadToRAM,
+	Compression:         options.Snappy,
 	// table.MemoryMap to mmap() the tables.
 	// table.Nothing to not preload the tables.
 	MaxLevels:               7,
@@ -99,11 +159,15 @@ var DefaultOptions = Options{
 	NumLevelZeroTables:      5,
 	NumLevelZeroTablesStall: 10,
 	NumMemtables:            5,
+	NumVersionsToKeep:       1,
 	SyncWrites:              true,
 	// Nothing to read/write value log using standard File I/O
 	// MemoryMap to mmap() the value log files
-	ValueLogFileSize: 1 << 30,
-	ValueThreshold:   20,
+	ValueLogFileSize:  1 << 30,
+	ValueThreshold:    20,
+	VerifyBytesPerSec: 64 << 20,
+	// Rotate the data keys every 10 days.
+	EncryptionKeyRotationDuration: 10 * 24 * time.Hour,
 }
 
 func (opt *Options) estimateSize(e *entry) int {
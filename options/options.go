@@ -28,3 +28,32 @@ const (
 	// MemoryMap indicates that that the file must be memory-mapped
 	MemoryMap
 )
+
+// CompressionType specifies how the blocks of LSM table files are compressed.
+type CompressionType uint32
+
+const (
+	// None mode indicates that a block is not compressed.
+	None CompressionType = 0
+	// Snappy mode indicates that a block is compressed using Snappy algorithm.
+	Snappy CompressionType = 1
+	// ZSTD mode indicates that a block is compressed using ZSTD algorithm.
+	ZSTD CompressionType = 2
+)
+
+// ChecksumVerificationMode specifies when the checksums of the blocks of LSM table files
+// should be verified. The checksum of the index of a table is always verified on open.
+type ChecksumVerificationMode int
+
+const (
+	// NoVerification indicates that the checksums of blocks are never verified.
+	NoVerification ChecksumVerificationMode = iota
+	// OnTableRead indicates that the checksums of all the blocks of a table are verified when
+	// the table is opened.
+	OnTableRead
+	// OnBlockRead indicates that the checksum of a block is verified every time it's read.
+	OnBlockRead
+	// OnTableAndBlockRead indicates that checksums are verified both when a table is opened,
+	// and every time a block is read.
+	OnTableAndBlockRead
+)
@@ -1,16 +1,6 @@
 // Code generated by protoc-gen-gogo. DO NOT EDIT.
 // source: manifest.proto
 
-/*
-	Package protos is a generated protocol buffer package.
-
-	It is generated from these files:
-		manifest.proto
-
-	It has these top-level messages:
-		ManifestChangeSet
-		ManifestChange
-*/
 package protos
 
 import proto "github.com/golang/protobuf/proto"
@@ -24,12 +14,6 @@ var _ = proto.Marshal
 var _ = fmt.Errorf
 var _ = math.Inf
 
-// This is a compile-time assertion to ensure that this generated file
-// is compatible with the proto package it is being compiled against.
-// A compilation error at this line likely means your copy of the
-// proto package needs to be updated.
-const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
-
 type ManifestChange_Operation int32
 
 const (
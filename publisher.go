@@ -0,0 +1,225 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/dgraph-io/badger/protos"
+	"github.com/dgraph-io/badger/y"
+)
+
+const (
+	// Number of batches of updates buffered for the publisher, and for each subscriber. Once
+	// these fill up, writes block until the subscribers catch up.
+	pubChCapacity = 1000
+	subChCapacity = 1000
+)
+
+type subscriber struct {
+	prefixes [][]byte
+	sendCh   chan *protos.KVList
+	done     chan struct{} // Closed once the subscriber stops receiving.
+}
+
+// matches returns the kvs the subscriber is interested in, or nil if there are none.
+func (s *subscriber) matches(kvs *protos.KVList) *protos.KVList {
+	if len(s.prefixes) == 0 {
+		return kvs
+	}
+	var out *protos.KVList
+	for _, kv := range kvs.Kv {
+		for _, p := range s.prefixes {
+			if bytes.HasPrefix(kv.Key, p) {
+				if out == nil {
+					out = &protos.KVList{}
+				}
+				out.Kv = append(out.Kv, kv)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// publisher fans out the updates written by writeRequests to the subscribers, in the order they
+// were written.
+type publisher struct {
+	sync.Mutex
+	pubCh       chan *protos.KVList
+	subscribers map[uint64]*subscriber
+	nextID      uint64
+	closed      bool
+}
+
+func newPublisher() *publisher {
+	return &publisher{
+		pubCh:       make(chan *protos.KVList, pubChCapacity),
+		subscribers: make(map[uint64]*subscriber),
+	}
+}
+
+func (p *publisher) hasSubscribers() bool {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.subscribers) > 0
+}
+
+// sendUpdates converts the entries of the written requests into KVs, and queues them up for the
+// subscribers. It must be called before the requests are marked done, as they get reused after.
+func (p *publisher) sendUpdates(reqs []*request) {
+	if !p.hasSubscribers() {
+		return
+	}
+	kvs := &protos.KVList{}
+	for _, req := range reqs {
+		for _, e := range req.Entries {
+			if e.Meta&bitFinTxn != 0 {
+				continue
+			}
+			key := y.ParseKey(e.Key)
+			if bytes.HasPrefix(key, badgerPrefix) {
+				continue
+			}
+			kvs.Kv = append(kvs.Kv, &protos.KV{
+				Key:       y.Safecopy(nil, key),
+				Value:     y.Safecopy(nil, e.Value),
+				UserMeta:  []byte{e.UserMeta},
+				Version:   y.ParseTs(e.Key),
+				ExpiresAt: e.ExpiresAt,
+				Deleted:   e.Meta&bitDelete != 0,
+			})
+		}
+	}
+	if len(kvs.Kv) > 0 {
+		p.pubCh <- kvs
+	}
+}
+
+func (p *publisher) publish(kvs *protos.KVList) {
+	p.Lock()
+	subs := make([]*subscriber, 0, len(p.subscribers))
+	for _, s := range p.subscribers {
+		subs = append(subs, s)
+	}
+	p.Unlock()
+
+	for _, s := range subs {
+		out := s.matches(kvs)
+		if out == nil {
+			continue
+		}
+		select {
+		case s.sendCh <- out:
+		case <-s.done:
+		}
+	}
+}
+
+func (p *publisher) listenForUpdates(lc *y.Closer) {
+	defer lc.Done()
+	for {
+		select {
+		case kvs := <-p.pubCh:
+			p.publish(kvs)
+		case <-lc.HasBeenClosed():
+			// Writes have stopped by now. Deliver what's left, and let the subscribers know
+			// there won't be anything more.
+			for {
+				select {
+				case kvs := <-p.pubCh:
+					p.publish(kvs)
+				default:
+					p.close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *publisher) close() {
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	for _, s := range p.subscribers {
+		close(s.sendCh)
+	}
+	p.subscribers = make(map[uint64]*subscriber)
+}
+
+func (p *publisher) newSubscriber(prefixes [][]byte) (uint64, *subscriber) {
+	p.Lock()
+	defer p.Unlock()
+	s := &subscriber{
+		prefixes: prefixes,
+		sendCh:   make(chan *protos.KVList, subChCapacity),
+		done:     make(chan struct{}),
+	}
+	if p.closed {
+		close(s.sendCh)
+		return 0, s
+	}
+	id := p.nextID
+	p.nextID++
+	p.subscribers[id] = s
+	return id, s
+}
+
+func (p *publisher) deleteSubscriber(id uint64) {
+	p.Lock()
+	defer p.Unlock()
+	if s, ok := p.subscribers[id]; ok {
+		delete(p.subscribers, id)
+		close(s.done)
+	}
+}
+
+// Subscribe can be used to watch key changes for the given key prefixes. If no prefixes are
+// given, all the keys are watched. The callback is called with batches of the updates committed
+// after the subscription started, in commit order. Each update carries the key, the value, the
+// version and user meta of the write, and whether it deleted the key.
+//
+// Slow subscribers hold up the writes to the DB, so that pending updates can't pile up in memory.
+// For the same reason, the callback must not wait on writes to this DB.
+//
+// Subscribe blocks until the context is done, the callback returns an error, or the DB is
+// closed. On close, the remaining updates are delivered before Subscribe returns nil.
+func (db *DB) Subscribe(ctx context.Context, cb func(kvs *protos.KVList) error,
+	prefixes ...[]byte) error {
+	if cb == nil {
+		return ErrNilCallback
+	}
+	id, s := db.pub.newSubscriber(prefixes)
+	for {
+		select {
+		case <-ctx.Done():
+			db.pub.deleteSubscriber(id)
+			return ctx.Err()
+		case kvs, ok := <-s.sendCh:
+			if !ok {
+				return nil // The DB has been closed.
+			}
+			if err := cb(kvs); err != nil {
+				db.pub.deleteSubscriber(id)
+				return err
+			}
+		}
+	}
+}
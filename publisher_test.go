@@ -0,0 +1,114 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/protos"
+	"github.com/stretchr/testify/require"
+)
+
+func waitForSubscriber(kv *DB) {
+	for !kv.pub.hasSubscribers() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPublisherOrdering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var updates []*protos.KV
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := kv.Subscribe(context.Background(), func(kvs *protos.KVList) error {
+			mu.Lock()
+			defer mu.Unlock()
+			updates = append(updates, kvs.Kv...)
+			return nil
+		}, []byte("key"))
+		require.NoError(t, err)
+	}()
+	waitForSubscriber(kv)
+
+	for i := 0; i < 5; i++ {
+		txnSet(t, kv, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), byte(i))
+	}
+	txnSet(t, kv, []byte("other"), []byte("value"), 0) // Not subscribed to.
+	txnDelete(t, kv, []byte("key0"))
+
+	// Close delivers the pending updates, and ends the subscription.
+	require.NoError(t, kv.Close())
+	wg.Wait()
+
+	require.Equal(t, 6, len(updates))
+	var lastVersion uint64
+	for i, u := range updates[:5] {
+		require.Equal(t, fmt.Sprintf("key%d", i), string(u.Key))
+		require.Equal(t, fmt.Sprintf("value%d", i), string(u.Value))
+		require.Equal(t, []byte{byte(i)}, u.UserMeta)
+		require.False(t, u.Deleted)
+		require.True(t, u.Version > lastVersion)
+		lastVersion = u.Version
+	}
+	require.Equal(t, "key0", string(updates[5].Key))
+	require.True(t, updates[5].Deleted)
+	require.True(t, updates[5].Version > lastVersion)
+}
+
+func TestPublisherCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	require.Equal(t, ErrNilCallback, kv.Subscribe(context.Background(), nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- kv.Subscribe(ctx, func(kvs *protos.KVList) error {
+			cancel()
+			return nil
+		})
+	}()
+	waitForSubscriber(kv)
+
+	txnSet(t, kv, []byte("key"), []byte("value"), 0)
+	require.Equal(t, context.Canceled, <-errCh)
+	require.False(t, kv.pub.hasSubscribers())
+
+	// Writes go through without the subscriber.
+	for i := 0; i < 10; i++ {
+		txnSet(t, kv, []byte(fmt.Sprintf("key%d", i)), []byte("value"), 0)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
+	"math"
 
 	"github.com/dgraph-io/badger/y"
 )
@@ -12,7 +13,7 @@ import (
 type valuePointer struct {
 	Fid    uint32
 	Len    uint32
-	Offset uint32
+	Offset uint64
 }
 
 func (p valuePointer) Less(o valuePointer) bool {
@@ -29,97 +30,177 @@ func (p valuePointer) IsZero() bool {
 	return p.Fid == 0 && p.Offset == 0 && p.Len == 0
 }
 
-const vptrSize = 12
+const (
+	// A pointer whose offset fits in 32 bits is encoded in vptrSize bytes, as it always was. Only
+	// the pointers past the first 4GB of a value log file take the 64 bit offsets of
+	// maxVptrSize bytes.
+	vptrSize    = 12
+	maxVptrSize = 16
+)
 
-// Encode encodes Pointer into byte buffer.
+// Encode encodes Pointer into byte buffer, which must have room for maxVptrSize bytes. It returns
+// the encoded bytes.
 func (p valuePointer) Encode(b []byte) []byte {
 	binary.BigEndian.PutUint32(b[:4], p.Fid)
 	binary.BigEndian.PutUint32(b[4:8], p.Len)
-	binary.BigEndian.PutUint32(b[8:12], p.Offset)
+	if p.Offset > math.MaxUint32 {
+		binary.BigEndian.PutUint64(b[8:16], p.Offset)
+		return b[:maxVptrSize]
+	}
+	binary.BigEndian.PutUint32(b[8:12], uint32(p.Offset))
 	return b[:vptrSize]
 }
 
+// Decode decodes the pointer from b, which holds exactly the bytes returned by Encode. Its length
+// tells the two encodings apart, so the pointers written before the offsets took 64 bits decode
+// as they are.
 func (p *valuePointer) Decode(b []byte) {
 	p.Fid = binary.BigEndian.Uint32(b[:4])
 	p.Len = binary.BigEndian.Uint32(b[4:8])
-	p.Offset = binary.BigEndian.Uint32(b[8:12])
+	if len(b) >= maxVptrSize {
+		p.Offset = binary.BigEndian.Uint64(b[8:16])
+		return
+	}
+	p.Offset = uint64(binary.BigEndian.Uint32(b[8:12]))
 }
 
 // header is used in value log as a header before Entry.
 type header struct {
-	klen     uint32
-	vlen     uint32
-	meta     byte
-	userMeta byte
+	klen      uint32
+	vlen      uint32
+	expiresAt uint64
+	meta      byte
+	userMeta  byte
 }
 
 const (
+	// The header of an entry is headerBufSize bytes, as it always was, unless the entry expires:
+	// then bitExpires is set in its meta, and the expiry time follows, for maxHeaderSize bytes.
 	headerBufSize = 10
+	maxHeaderSize = headerBufSize + 8
+
+	// The key and value of an encrypted entry are preceded by the id of the data key and the IV
+	// they're encrypted with.
+	encryptionHeaderSize = 8 + y.IVSize
 )
 
-func (h header) Encode(out []byte) {
-	y.AssertTrue(len(out) >= headerBufSize)
+// Encode encodes h into out, which must have room for maxHeaderSize bytes. It returns the number
+// of bytes written.
+func (h header) Encode(out []byte) int {
+	y.AssertTrue(len(out) >= maxHeaderSize)
 	binary.BigEndian.PutUint32(out[0:4], h.klen)
 	binary.BigEndian.PutUint32(out[4:8], h.vlen)
 	out[8] = h.meta
 	out[9] = h.userMeta
+	if h.expiresAt == 0 {
+		return headerBufSize
+	}
+	out[8] |= bitExpires
+	binary.BigEndian.PutUint64(out[headerBufSize:maxHeaderSize], h.expiresAt)
+	return maxHeaderSize
 }
 
-// Decodes h from buf.
-func (h *header) Decode(buf []byte) {
+// Decodes h from buf, which holds the first headerBufSize bytes of the header, and the expiry time
+// too if the entry expires. Returns the size of the header.
+func (h *header) Decode(buf []byte) int {
 	h.klen = binary.BigEndian.Uint32(buf[0:4])
 	h.vlen = binary.BigEndian.Uint32(buf[4:8])
-	h.meta = buf[8]
+	h.meta = buf[8] &^ bitExpires
 	h.userMeta = buf[9]
+	if buf[8]&bitExpires == 0 {
+		h.expiresAt = 0
+		return headerBufSize
+	}
+	h.expiresAt = binary.BigEndian.Uint64(buf[headerBufSize:maxHeaderSize])
+	return maxHeaderSize
 }
 
 // entry provides Key, Value and if required, CASCounterCheck to kv.BatchSet() API.
 // If CASCounterCheck is provided, it would be compared against the current casCounter
 // assigned to this key-value. Set be done on this key only if the counters match.
 type entry struct {
-	Key      []byte
-	Value    []byte
-	Meta     byte
-	UserMeta byte
+	Key       []byte
+	Value     []byte
+	Meta      byte
+	UserMeta  byte
+	ExpiresAt uint64 // time.Unix
 
 	// Fields maintained internally.
-	offset uint32
+	offset uint64
 }
 
 func (e *entry) estimateSize(threshold int) int {
 	if len(e.Value) < threshold {
 		return len(e.Key) + len(e.Value) + 2 // Meta, UserMeta
 	}
-	return len(e.Key) + 12 + 2 // 12 for ValuePointer, 2 for metas.
+	return len(e.Key) + maxVptrSize + 2 // 2 for metas.
 }
 
-// Encodes e to buf. Returns number of bytes written.
-func encodeEntry(e *entry, buf *bytes.Buffer) (int, error) {
+// Encodes e to buf, with its key and value encrypted with dk, unless dk is nil. Returns number
+// of bytes written.
+func encodeEntry(e *entry, buf *bytes.Buffer, dk *y.DataKey) (int, error) {
 	var h header
 	h.klen = uint32(len(e.Key))
 	h.vlen = uint32(len(e.Value))
+	h.expiresAt = e.ExpiresAt
 	h.meta = e.Meta
 	h.userMeta = e.UserMeta
+	if dk != nil {
+		h.meta |= bitEncrypted
+	}
 
-	var headerEnc [headerBufSize]byte
-	h.Encode(headerEnc[:])
+	var headerEnc [maxHeaderSize]byte
+	n := h.Encode(headerEnc[:])
 
 	hash := crc32.New(y.CastagnoliCrcTable)
 
-	buf.Write(headerEnc[:])
-	hash.Write(headerEnc[:])
-
-	buf.Write(e.Key)
-	hash.Write(e.Key)
-
-	buf.Write(e.Value)
-	hash.Write(e.Value)
+	buf.Write(headerEnc[:n])
+	hash.Write(headerEnc[:n])
+
+	if dk != nil {
+		iv, err := y.GenerateIV()
+		if err != nil {
+			return 0, err
+		}
+		var encHeader [encryptionHeaderSize]byte
+		binary.BigEndian.PutUint64(encHeader[:8], dk.ID)
+		copy(encHeader[8:], iv)
+		buf.Write(encHeader[:])
+		hash.Write(encHeader[:])
+
+		data := make([]byte, len(e.Key)+len(e.Value))
+		copy(data, e.Key)
+		copy(data[len(e.Key):], e.Value)
+		dk.XOR(data, data, iv)
+		buf.Write(data)
+		hash.Write(data)
+		n += len(encHeader) + len(data)
+	} else {
+		buf.Write(e.Key)
+		hash.Write(e.Key)
+
+		buf.Write(e.Value)
+		hash.Write(e.Value)
+		n += len(e.Key) + len(e.Value)
+	}
 
 	var crcBuf [4]byte
 	binary.BigEndian.PutUint32(crcBuf[:], hash.Sum32())
 	buf.Write(crcBuf[:])
 
-	return len(headerEnc) + len(e.Key) + len(e.Value) + len(crcBuf), nil
+	return n + len(crcBuf), nil
+}
+
+// encodedSize returns the number of bytes encodeEntry writes for e, when encrypted or not.
+func (e *entry) encodedSize(encrypted bool) int {
+	n := headerBufSize + len(e.Key) + len(e.Value) + crc32.Size
+	if e.ExpiresAt != 0 {
+		n += maxHeaderSize - headerBufSize
+	}
+	if encrypted {
+		n += encryptionHeaderSize
+	}
+	return n
 }
 
 func (e entry) print(prefix string) {
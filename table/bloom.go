@@ -0,0 +1,118 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"math"
+
+	"github.com/AndreasBriese/bbloom"
+	farm "github.com/dgryski/go-farm"
+	"github.com/pkg/errors"
+)
+
+// The first byte of the bloom filter section of a table tells its encoding. Tables written
+// before the binary encoding hold a JSON encoded bbloom.Bloom, which starts with '{'.
+const (
+	bloomFormatBinary = 1
+	bloomFormatJSON   = '{'
+)
+
+type filter interface {
+	Has(key []byte) bool
+}
+
+// bloomFilter is a bloom filter in the format used by LevelDB: the bitset, followed by one byte
+// holding the number of probes per key. It's used in place from the table data.
+type bloomFilter []byte
+
+func bloomHash(key []byte) uint32 { return farm.Fingerprint32(key) }
+
+// bloomBitsPerKey returns the number of bits per key needed for the given false positive rate.
+func bloomBitsPerKey(fp float64) int {
+	return int(math.Ceil(-math.Log(fp) / (math.Ln2 * math.Ln2)))
+}
+
+// newBloomFilter returns a filter of the keys with the given hashes.
+func newBloomFilter(hashes []uint32, bitsPerKey int) bloomFilter {
+	if bitsPerKey < 1 {
+		bitsPerKey = 1
+	}
+	// The optimal number of probes is bitsPerKey * ln(2).
+	k := uint32(float64(bitsPerKey) * math.Ln2)
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+
+	// Very small filters would see a high false positive rate, so have at least 64 bits.
+	nBits := len(hashes) * bitsPerKey
+	if nBits < 64 {
+		nBits = 64
+	}
+	nBytes := (nBits + 7) / 8
+	nBits = nBytes * 8
+	f := make([]byte, nBytes+1)
+	for _, h := range hashes {
+		// Double hashing, as in LevelDB, derives the k probes from a single hash.
+		delta := h>>17 | h<<15
+		for j := uint32(0); j < k; j++ {
+			pos := h % uint32(nBits)
+			f[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	f[nBytes] = uint8(k)
+	return f
+}
+
+// Has returns false if the key is definitely not in the filter.
+func (f bloomFilter) Has(key []byte) bool {
+	if len(f) < 2 {
+		return false
+	}
+	k := f[len(f)-1]
+	if k > 30 {
+		// Reserved for potentially new encodings. Consider it a match.
+		return true
+	}
+	nBits := uint32(8 * (len(f) - 1))
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for j := uint8(0); j < k; j++ {
+		pos := h % nBits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// decodeFilter decodes the bloom filter section of a table, in either encoding.
+func decodeFilter(data []byte) (filter, error) {
+	if len(data) == 0 {
+		return nil, errors.Wrap(ErrCorruptTable, "empty bloom filter")
+	}
+	switch data[0] {
+	case bloomFormatBinary:
+		return bloomFilter(data[1:]), nil
+	case bloomFormatJSON:
+		return bbloom.JSONUnmarshal(data), nil
+	}
+	return nil, errors.Wrapf(ErrCorruptTable, "unknown bloom filter format: %d", data[0])
+}
@@ -19,11 +19,12 @@ package table
 import (
 	"bytes"
 	"encoding/binary"
-	"io"
+	"hash/crc32"
 	"math"
 
-	"github.com/AndreasBriese/bbloom"
+	"github.com/dgraph-io/badger/options"
 	"github.com/dgraph-io/badger/y"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -73,22 +74,44 @@ type Builder struct {
 	baseKey    []byte // Base key for the current block.
 	baseOffset uint32 // Offset for the current block.
 
-	restarts []uint32 // Base offsets of every block.
+	restarts  []uint32 // Base offsets of every block.
+	blockKeys [][]byte // Base keys of every finished block.
+	keysSize  int      // Size of blockKeys, as written out in the index.
 
 	// Tracks offset for the previous key-value pair. Offset is relative to block base offset.
 	prevOffset uint32
 
-	keyBuf   *bytes.Buffer
-	keyCount int
+	keyHashes []uint32 // Hashes of the keys (without timestamps), for the bloom filter.
+
+	compression        options.CompressionType // Used for the blocks written from now on.
+	bloomFalsePositive float64
+	dataKey            *y.DataKey // Encrypts the blocks and the index, if not nil.
+
+	props Properties // Written out in the footer.
 }
 
-// NewTableBuilder makes a new TableBuilder.
-func NewTableBuilder() *Builder {
+// NewTableBuilder makes a new TableBuilder, which compresses the blocks it writes with the given
+// algorithm, and sizes the bloom filter of the table for the given false positive rate. If
+// dataKey isn't nil, the blocks and the index are encrypted with it.
+func NewTableBuilder(compression options.CompressionType, bloomFalsePositive float64,
+	dataKey *y.DataKey) *Builder {
 	return &Builder{
-		keyBuf:     newBuffer(1 << 20),
-		buf:        newBuffer(1 << 20),
-		prevOffset: math.MaxUint32, // Used for the first element!
+		buf:                newBuffer(1 << 20),
+		prevOffset:         math.MaxUint32, // Used for the first element!
+		compression:        compression,
+		bloomFalsePositive: bloomFalsePositive,
+		dataKey:            dataKey,
+	}
+}
+
+// encrypt encrypts data in place, and returns the IV it used.
+func (b *Builder) encrypt(data []byte) ([]byte, error) {
+	iv, err := y.GenerateIV()
+	if err != nil {
+		return nil, errors.Wrap(err, "While encrypting table")
 	}
+	b.dataKey.XOR(data, data, iv)
+	return iv, nil
 }
 
 // Close closes the TableBuilder.
@@ -109,14 +132,13 @@ func (b Builder) keyDiff(newKey []byte) []byte {
 }
 
 func (b *Builder) addHelper(key []byte, v y.ValueStruct) {
-	// Add key to bloom filter.
+	// Add key to bloom filter. The versions of a key are added next to each other, and only
+	// need to be added once.
 	if len(key) > 0 {
-		var klen [2]byte
-		keyNoTs := y.ParseKey(key)
-		binary.BigEndian.PutUint16(klen[:], uint16(len(keyNoTs)))
-		b.keyBuf.Write(klen[:])
-		b.keyBuf.Write(keyNoTs)
-		b.keyCount++
+		h := bloomHash(y.ParseKey(key))
+		if n := len(b.keyHashes); n == 0 || b.keyHashes[n-1] != h {
+			b.keyHashes = append(b.keyHashes, h)
+		}
 	}
 
 	// diffKey stores the difference of key with baseKey.
@@ -144,25 +166,55 @@ func (b *Builder) addHelper(key []byte, v y.ValueStruct) {
 	b.buf.Write(hbuf[:])
 	b.buf.Write(diffKey) // We only need to store the key difference.
 
-	// This should be kept in sync with ValueStruct encode function.
-	b.buf.WriteByte(v.Meta) // Meta byte precedes actual value.
-	b.buf.WriteByte(v.UserMeta)
-	b.buf.Write(v.Value)
+	v.EncodeTo(b.buf)
 
 	b.counter++ // Increment number of keys added for this current block.
 }
 
-func (b *Builder) finishBlock() {
+func (b *Builder) finishBlock() error {
 	// When we are at the end of the block and Valid=false, and the user wants to do a Prev,
 	// we need a dummy header to tell us the offset of the previous key-value pair.
 	b.addHelper([]byte{}, y.ValueStruct{})
+
+	// All the offsets within the block are relative to the uncompressed block, so it can only be
+	// compressed once it's complete. Keep it as is if compressing doesn't save any space.
+	data := b.buf.Bytes()[b.baseOffset:]
+	b.props.RawSize += uint64(len(data))
+	ct := b.compression
+	compressed, err := compress(ct, data)
+	if err != nil {
+		return err
+	}
+	if len(compressed) >= len(data) {
+		ct, compressed = options.None, data
+	}
+	if ct != options.None {
+		b.buf.Truncate(int(b.baseOffset))
+		b.buf.Write(compressed)
+	}
+	if b.dataKey != nil {
+		iv, err := b.encrypt(b.buf.Bytes()[b.baseOffset:])
+		if err != nil {
+			return err
+		}
+		b.buf.Write(iv)
+	}
+	b.buf.WriteByte(byte(ct))
+	b.writeChecksum(b.buf.Bytes()[b.baseOffset:])
+	b.props.OnDiskSize += uint64(b.buf.Len()) - uint64(b.baseOffset)
+
+	b.blockKeys = append(b.blockKeys, b.baseKey)
+	b.keysSize += 2 + len(b.baseKey)
+	return nil
 }
 
 // Add adds a key-value pair to the block.
 // If doNotRestart is true, we will not restart even if b.counter >= restartInterval.
 func (b *Builder) Add(key []byte, value y.ValueStruct) error {
 	if b.counter >= restartInterval {
-		b.finishBlock()
+		if err := b.finishBlock(); err != nil {
+			return err
+		}
 		// Start a new block. Initialize the block.
 		b.restarts = append(b.restarts, uint32(b.buf.Len()))
 		b.counter = 0
@@ -171,7 +223,19 @@ func (b *Builder) Add(key []byte, value y.ValueStruct) error {
 		b.prevOffset = math.MaxUint32 // First key-value pair of block has header.prev=MaxInt.
 	}
 	b.addHelper(key, value)
-	return nil // Currently, there is no meaningful error.
+
+	version := y.ParseTs(key)
+	if b.props.KeyCount == 0 || version < b.props.MinVersion {
+		b.props.MinVersion = version
+	}
+	if version > b.props.MaxVersion {
+		b.props.MaxVersion = version
+	}
+	b.props.KeyCount++
+	if value.Meta&bitDelete != 0 {
+		b.props.TombstoneCount++
+	}
+	return nil
 }
 
 // TODO: vvv this was the comment on ReachedCapacity.
@@ -181,20 +245,27 @@ func (b *Builder) Add(key []byte, value y.ValueStruct) error {
 
 // ReachedCapacity returns true if we... roughly (?) reached capacity?
 func (b *Builder) ReachedCapacity(cap int64) bool {
-	estimateSz := b.buf.Len() + 8 /* empty header */ + 4*len(b.restarts) + 8 // 8 = end of buf offset + len(restarts).
+	estimateSz := b.buf.Len() + 8 /* empty header */ + b.keysSize + 4*len(b.restarts) +
+		8 /* end of buf offset + len(restarts) */ + footerSize
 	return int64(estimateSz) > cap
 }
 
 // blockIndex generates the block index for the table.
-// It is mainly a list of all the block base offsets.
+// It is the list of all the block base keys, followed by the list of all the block base offsets.
+// The base keys are laid out between the end of the last block and the offsets.
 func (b *Builder) blockIndex() []byte {
 	// Store the end offset, so we know the length of the final block.
 	b.restarts = append(b.restarts, uint32(b.buf.Len()))
 
 	// Add 4 because we want to write out number of restarts at the end.
-	sz := 4*len(b.restarts) + 4
+	sz := b.keysSize + 4*len(b.restarts) + 4
 	out := make([]byte, sz)
 	buf := out
+	for _, k := range b.blockKeys {
+		binary.BigEndian.PutUint16(buf[:2], uint16(len(k)))
+		copy(buf[2:], k)
+		buf = buf[2+len(k):]
+	}
 	for _, r := range b.restarts {
 		binary.BigEndian.PutUint32(buf[:4], r)
 		buf = buf[4:]
@@ -203,37 +274,74 @@ func (b *Builder) blockIndex() []byte {
 	return out
 }
 
-// Finish finishes the table by appending the index.
-func (b *Builder) Finish() []byte {
-	bf := bbloom.New(float64(b.keyCount), 0.01)
-	var klen [2]byte
-	key := make([]byte, 1024)
-	for {
-		if _, err := b.keyBuf.Read(klen[:]); err == io.EOF {
-			break
-		} else if err != nil {
-			y.Check(err)
-		}
-		kl := int(binary.BigEndian.Uint16(klen[:]))
-		if cap(key) < kl {
-			key = make([]byte, 2*kl)
-		}
-		key = key[:kl]
-		y.Check2(b.keyBuf.Read(key))
-		bf.Add(key)
-	}
+// writeChecksum appends the checksum of data to the table.
+func (b *Builder) writeChecksum(data []byte) {
+	var buf [checksumSize]byte
+	binary.BigEndian.PutUint32(buf[:], crc32.Checksum(data, y.CastagnoliCrcTable))
+	b.buf.Write(buf[:])
+}
 
-	b.finishBlock() // This will never start a new block.
+// Finish finishes the table by appending the index and the footer. The layout of the table is:
+//
+//	block 1 | ... | block n | block index | bloom filter | bloom length (4) |
+//	properties (48) | index length (4) | checksum (4) | version (4) | magic (4)
+//
+// where each block is followed by its compression type (1) and its checksum (4). The index
+// length covers everything from the block index up to the bloom length, and the checksum covers
+// the index and the properties. Everything from the properties on has a fixed size.
+//
+// An encrypted table has the layout of encryptedTableVersion instead:
+//
+//	block 1 | ... | block n | encrypted index | properties (48) | key id (8) | index IV (16) |
+//	index length (4) | checksum (4) | version (4) | magic (4)
+//
+// where each block is encrypted after it's compressed, and followed by its IV (16), its
+// compression type (1) and its checksum (4). The index is what lies between the end of the last
+// block and the properties in an unencrypted table. The checksums cover the encrypted bytes, and
+// the checksum of the index covers everything up to the index length.
+func (b *Builder) Finish() ([]byte, error) {
+	if err := b.finishBlock(); err != nil { // This will never start a new block.
+		return nil, err
+	}
+	indexStart := b.buf.Len()
 	index := b.blockIndex()
 	b.buf.Write(index)
 
 	// Write bloom filter.
-	bdata := bf.JSONMarshal()
-	n, err := b.buf.Write(bdata)
-	y.Check(err)
+	bf := newBloomFilter(b.keyHashes, bloomBitsPerKey(b.bloomFalsePositive))
+	b.buf.WriteByte(bloomFormatBinary)
+	b.buf.Write(bf)
 	var buf [4]byte
-	binary.BigEndian.PutUint32(buf[:], uint32(n))
+	binary.BigEndian.PutUint32(buf[:], uint32(1+len(bf)))
+	b.buf.Write(buf[:])
+
+	indexLen := b.buf.Len() - indexStart
+	var iv []byte
+	if b.dataKey != nil {
+		var err error
+		if iv, err = b.encrypt(b.buf.Bytes()[indexStart:]); err != nil {
+			return nil, err
+		}
+	}
+	var props [propertiesSize]byte
+	b.props.encode(props[:])
+	b.buf.Write(props[:])
+	version := uint32(tableVersion)
+	if b.dataKey != nil {
+		version = encryptedTableVersion
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], b.dataKey.ID)
+		b.buf.Write(id[:])
+		b.buf.Write(iv)
+	}
+	checksumData := b.buf.Bytes()[indexStart:]
+	binary.BigEndian.PutUint32(buf[:], uint32(indexLen))
+	b.buf.Write(buf[:])
+	b.writeChecksum(checksumData)
+
+	binary.BigEndian.PutUint32(buf[:], version)
 	b.buf.Write(buf[:])
+	b.buf.Write(tableMagic[:])
 
-	return b.buf.Bytes()
+	return b.buf.Bytes(), nil
 }
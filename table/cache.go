@@ -0,0 +1,136 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// The cache is split into shards, each with its own lock and LRU list, so that concurrent
+// readers don't all contend on one lock.
+const cacheShards = 16
+
+type cacheKey struct {
+	tableID uint64
+	idx     int // Index of the block in the table.
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	data []byte
+}
+
+type cacheShard struct {
+	sync.Mutex
+	maxSize int64
+	size    int64
+	ll      *list.List // Front is the most recently used.
+	items   map[cacheKey]*list.Element
+}
+
+// Cache is an LRU cache of the blocks read from tables, bounded by the total size of the blocks.
+// It's safe for concurrent use, and is meant to be shared by all the tables of a DB. A nil
+// *Cache caches nothing.
+type Cache struct {
+	shards [cacheShards]cacheShard
+}
+
+// NewCache returns a Cache holding up to maxSize bytes of blocks, or nil if maxSize is not
+// positive.
+func NewCache(maxSize int64) *Cache {
+	if maxSize <= 0 {
+		return nil
+	}
+	c := &Cache{}
+	for i := range c.shards {
+		c.shards[i].maxSize = maxSize / cacheShards
+		c.shards[i].ll = list.New()
+		c.shards[i].items = make(map[cacheKey]*list.Element)
+	}
+	return c
+}
+
+func (c *Cache) shard(key cacheKey) *cacheShard {
+	// Consecutive blocks of a table, and the same block of consecutive tables, land on
+	// different shards.
+	return &c.shards[(key.tableID*7+uint64(key.idx))%cacheShards]
+}
+
+// get returns the block data for key, and records a hit or a miss.
+func (c *Cache) get(key cacheKey) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		y.NumBlockCacheMisses.Add(1)
+		return nil, false
+	}
+	y.NumBlockCacheHits.Add(1)
+	s.ll.MoveToFront(el)
+	return el.Value.(*cacheEntry).data, true
+}
+
+// set caches data for key, evicting the least recently used blocks to make room for it. data
+// must not be modified afterwards.
+func (c *Cache) set(key cacheKey, data []byte) {
+	if c == nil {
+		return
+	}
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	if int64(len(data)) > s.maxSize {
+		return
+	}
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	s.items[key] = s.ll.PushFront(&cacheEntry{key: key, data: data})
+	s.size += int64(len(data))
+	for s.size > s.maxSize {
+		s.remove(s.ll.Back())
+	}
+}
+
+// dropTable evicts the numBlocks blocks of the given table.
+func (c *Cache) dropTable(tableID uint64, numBlocks int) {
+	if c == nil {
+		return
+	}
+	for i := 0; i < numBlocks; i++ {
+		key := cacheKey{tableID: tableID, idx: i}
+		s := c.shard(key)
+		s.Lock()
+		if el, ok := s.items[key]; ok {
+			s.remove(el)
+		}
+		s.Unlock()
+	}
+}
+
+func (s *cacheShard) remove(el *list.Element) {
+	e := s.ll.Remove(el).(*cacheEntry)
+	delete(s.items, e.key)
+	s.size -= int64(len(e.data))
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"github.com/dgraph-io/badger/options"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Every block is followed by one byte holding the options.CompressionType it was written with,
+// so tables (and blocks) written with different settings can be read alike.
+const compressionTypeSize = 1
+
+// The zstd encoder and decoder are safe for concurrent use via EncodeAll and DecodeAll.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// compress returns data compressed with the given algorithm. It never modifies data.
+func compress(ct options.CompressionType, data []byte) ([]byte, error) {
+	switch ct {
+	case options.None:
+		return data, nil
+	case options.Snappy:
+		return snappy.Encode(nil, data), nil
+	case options.ZSTD:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, errors.Errorf("Unsupported compression type: %d", ct)
+}
+
+// decompress is the inverse of compress. For options.None, it returns data as is.
+func decompress(ct options.CompressionType, data []byte) ([]byte, error) {
+	switch ct {
+	case options.None:
+		return data, nil
+	case options.Snappy:
+		return snappy.Decode(nil, data)
+	case options.ZSTD:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, errors.Errorf("Unsupported compression type: %d", ct)
+}
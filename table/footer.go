@@ -0,0 +1,84 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// Every table ends with these 4 bytes, so that truncated or foreign files can be told apart.
+var tableMagic = [4]byte{'B', 'd', 'g', 'T'}
+
+// The versions of the table format, written right before the magic. A new one is needed whenever
+// the layout described in Builder.Finish changes. The encrypted tables have a layout of their own,
+// so that the unencrypted ones are written as they always were. Tables written before the footer
+// was added have neither a version nor the magic, and are read as legacyTableVersion.
+const (
+	legacyTableVersion    = 0
+	tableVersion          = 1
+	encryptedTableVersion = 2
+)
+
+const (
+	propertiesSize = 6 * 8
+	// The footer holds the properties, the length of the index, the checksum of the index and the
+	// properties, the version and the magic.
+	footerSize = propertiesSize + 4 + checksumSize + 4 + len(tableMagic)
+	// The footer of an encrypted table also holds the ID of its data key, and the IV of its
+	// index, after the properties.
+	encryptedFooterSize = footerSize + 8 + y.IVSize
+)
+
+// The meta bit set on the entries marking a deletion. It must match badger's bitDelete.
+const bitDelete byte = 1 << 0
+
+// Properties are the statistics of a table, recorded in its footer when it's built.
+type Properties struct {
+	KeyCount       uint64 // Number of entries, counting every version of a key.
+	TombstoneCount uint64 // Number of entries marking a deletion.
+	MinVersion     uint64 // Smallest version of any entry. Zero if the table is empty.
+	MaxVersion     uint64 // Largest version of any entry.
+	RawSize        uint64 // Size of the blocks before compression.
+	OnDiskSize     uint64 // Size of the blocks as written, after compression.
+}
+
+func (p Properties) String() string {
+	return fmt.Sprintf("keys=%d tombstones=%d min_version=%d max_version=%d raw_size=%d "+
+		"on_disk_size=%d", p.KeyCount, p.TombstoneCount, p.MinVersion, p.MaxVersion, p.RawSize,
+		p.OnDiskSize)
+}
+
+func (p Properties) encode(b []byte) {
+	binary.BigEndian.PutUint64(b[0:8], p.KeyCount)
+	binary.BigEndian.PutUint64(b[8:16], p.TombstoneCount)
+	binary.BigEndian.PutUint64(b[16:24], p.MinVersion)
+	binary.BigEndian.PutUint64(b[24:32], p.MaxVersion)
+	binary.BigEndian.PutUint64(b[32:40], p.RawSize)
+	binary.BigEndian.PutUint64(b[40:48], p.OnDiskSize)
+}
+
+func (p *Properties) decode(b []byte) {
+	p.KeyCount = binary.BigEndian.Uint64(b[0:8])
+	p.TombstoneCount = binary.BigEndian.Uint64(b[8:16])
+	p.MinVersion = binary.BigEndian.Uint64(b[16:24])
+	p.MaxVersion = binary.BigEndian.Uint64(b[24:32])
+	p.RawSize = binary.BigEndian.Uint64(b[32:40])
+	p.OnDiskSize = binary.BigEndian.Uint64(b[40:48])
+}
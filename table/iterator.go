@@ -224,6 +224,15 @@ func (itr *Iterator) Valid() bool {
 	return itr.err == nil
 }
 
+// Error returns the error that made the iterator invalid, like a block failing its checksum. It
+// returns nil if the iterator is valid, or simply ran past the end of the table.
+func (itr *Iterator) Error() error {
+	if itr.err == io.EOF {
+		return nil
+	}
+	return itr.err
+}
+
 func (itr *Iterator) seekToFirst() {
 	numBlocks := len(itr.t.blockIndex)
 	if numBlocks == 0 {
@@ -320,6 +329,9 @@ func (itr *Iterator) seek(key []byte) {
 func (itr *Iterator) seekForPrev(key []byte) {
 	// TODO: Optimize this. We shouldn't have to take a Prev step.
 	itr.seekFrom(key, origin)
+	if itr.Error() != nil {
+		return
+	}
 	if !bytes.Equal(itr.Key(), key) {
 		itr.prev()
 	}
@@ -387,7 +399,12 @@ func (itr *Iterator) Key() []byte {
 
 // Value follows the y.Iterator interface
 func (itr *Iterator) Value() (ret y.ValueStruct) {
-	ret.Decode(itr.bi.Value())
+	v := itr.bi.Value()
+	if itr.t.version == legacyTableVersion {
+		// The values of the legacy layout have no expiry.
+		return y.ValueStruct{Meta: v[0], UserMeta: v[1], Value: v[2:]}
+	}
+	ret.Decode(v)
 	return
 }
 
@@ -469,6 +486,14 @@ func (s *ConcatIterator) Valid() bool {
 	return s.cur != nil && s.cur.Valid()
 }
 
+// Error returns the error that made the iterator invalid, if it didn't simply run past the end.
+func (s *ConcatIterator) Error() error {
+	if s.cur == nil {
+		return nil
+	}
+	return s.cur.Error()
+}
+
 // Key implements y.Interface
 func (s *ConcatIterator) Key() []byte {
 	return s.cur.Key()
@@ -505,8 +530,8 @@ func (s *ConcatIterator) Seek(key []byte) {
 // Next advances our concat iterator.
 func (s *ConcatIterator) Next() {
 	s.cur.Next()
-	if s.cur.Valid() {
-		// Nothing to do. Just stay with the current table.
+	if s.cur.Valid() || s.cur.Error() != nil {
+		// Nothing to do. Just stay with the current table, or its error.
 		return
 	}
 	for { // In case there are empty tables.
@@ -520,7 +545,7 @@ func (s *ConcatIterator) Next() {
 			return
 		}
 		s.cur.Rewind()
-		if s.cur.Valid() {
+		if s.cur.Valid() || s.cur.Error() != nil {
 			break
 		}
 	}
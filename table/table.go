@@ -17,8 +17,10 @@
 package table
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path"
 	"path/filepath"
@@ -28,7 +30,6 @@ import (
 	"sync"
 	"sync/atomic"
 
-	"github.com/AndreasBriese/bbloom"
 	"github.com/dgraph-io/badger/options"
 	"github.com/dgraph-io/badger/y"
 	"github.com/pkg/errors"
@@ -36,6 +37,38 @@ import (
 
 const fileSuffix = ".sst"
 
+const (
+	// Every block, and the index, is followed by the CRC32 (Castagnoli) checksum of its bytes.
+	checksumSize = 4
+	// A block is followed by its compression type and its checksum.
+	blockTrailerSize = compressionTypeSize + checksumSize
+)
+
+var (
+	// ErrChecksumMismatch is returned when a block or the index of a table doesn't match its
+	// checksum.
+	ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+	// ErrCorruptTable is returned when a table can't be parsed.
+	ErrCorruptTable = errors.New("Table is corrupt")
+
+	// ErrUnsupportedVersion is returned when a table was written in a format version this code
+	// doesn't know of.
+	ErrUnsupportedVersion = errors.New("Unsupported table version")
+)
+
+// DataKeys looks up the data keys which the tables are encrypted with, by the IDs recorded in them.
+type DataKeys interface {
+	DataKey(id uint64) (*y.DataKey, error)
+}
+
+func verifyChecksum(data []byte, expected uint32) error {
+	if actual := crc32.Checksum(data, y.CastagnoliCrcTable); actual != expected {
+		return errors.Wrapf(ErrChecksumMismatch, "actual: %d, expected: %d", actual, expected)
+	}
+	return nil
+}
+
 type keyOffset struct {
 	key    []byte
 	offset int
@@ -53,13 +86,18 @@ type Table struct {
 	ref        int32 // For file garbage collection.  Atomic.
 
 	loadingMode options.FileLoadingMode
+	chkMode     options.ChecksumVerificationMode
 	mmap        []byte // Memory mapped.
+	cache       *Cache // Shared with other tables. Can be nil.
 
 	// The following are initialized once and const.
 	smallest, biggest []byte // Smallest and largest keys.
 	id                uint64 // file id, part of filename
 
-	bf bbloom.Bloom
+	version uint32 // Format version, see tableVersion.
+	bf      filter
+	props   Properties // Zero for tables of the legacy layout.
+	dataKey *y.DataKey // Set if the table is encrypted.
 }
 
 // IncrRef increments the refcount (having to do with whether the file should be deleted)
@@ -73,6 +111,7 @@ func (t *Table) DecrRef() error {
 	if newRef == 0 {
 		// We can safely delete this file, because for all the current files, we always have
 		// at least one reference pointing to them.
+		t.cache.dropTable(t.id, len(t.blockIndex)) // Its blocks won't be read anymore.
 
 		// It's necessary to delete windows files
 		if t.loadingMode == options.MemoryMap {
@@ -111,8 +150,11 @@ func (b byKey) Less(i int, j int) bool { return y.CompareKeys(b[i].key, b[j].key
 // OpenTable assumes file has only one table and opens it.  Takes ownership of fd upon function
 // entry.  Returns a table with one reference count on it (decrementing which may delete the file!
 // -- consider t.Close() instead).  The fd has to writeable because we call Truncate on it before
-// deleting.
-func OpenTable(fd *os.File, loadingMode options.FileLoadingMode) (*Table, error) {
+// deleting. The checksums of the blocks are verified as per chkMode, while the index is always
+// verified. The blocks read are kept in cache, if it's not nil. The data key of an encrypted table
+// is looked up in keys.
+func OpenTable(fd *os.File, loadingMode options.FileLoadingMode,
+	chkMode options.ChecksumVerificationMode, cache *Cache, keys DataKeys) (*Table, error) {
 	fileInfo, err := fd.Stat()
 	if err != nil {
 		// It's OK to ignore fd.Close() errs in this function because we have only read
@@ -132,6 +174,8 @@ func OpenTable(fd *os.File, loadingMode options.FileLoadingMode) (*Table, error)
 		ref:         1, // Caller is given one reference.
 		id:          id,
 		loadingMode: loadingMode,
+		chkMode:     chkMode,
+		cache:       cache,
 	}
 
 	t.tableSize = int(fileInfo.Size())
@@ -150,16 +194,33 @@ func OpenTable(fd *os.File, loadingMode options.FileLoadingMode) (*Table, error)
 		}
 	}
 
-	if err := t.readIndex(); err != nil {
+	if err := t.readIndex(keys); err != nil {
+		_ = t.Close()
+		return nil, y.Wrap(err)
+	}
+	if chkMode == options.OnTableRead || chkMode == options.OnTableAndBlockRead {
+		if err := t.VerifyChecksum(); err != nil {
+			_ = t.Close()
+			return nil, y.Wrap(err)
+		}
+	}
+	if err := t.initBiggestAndSmallest(); err != nil {
+		_ = t.Close()
 		return nil, y.Wrap(err)
 	}
+	return t, nil
+}
 
+func (t *Table) initBiggestAndSmallest() error {
 	it := t.NewIterator(false)
 	defer it.Close()
 	it.Rewind()
 	if it.Valid() {
 		t.smallest = it.Key()
 	}
+	if err := it.Error(); err != nil {
+		return err
+	}
 
 	it2 := t.NewIterator(true)
 	defer it2.Close()
@@ -167,7 +228,7 @@ func OpenTable(fd *os.File, loadingMode options.FileLoadingMode) (*Table, error)
 	if it2.Valid() {
 		t.biggest = it2.Key()
 	}
-	return t, nil
+	return it2.Error()
 }
 
 // Close closes the open table.  (Releases resources back to the OS.)
@@ -196,29 +257,105 @@ func (t *Table) read(off int, sz int) ([]byte, error) {
 	return res, err
 }
 
-func (t *Table) readNoFail(off int, sz int) []byte {
-	res, err := t.read(off, sz)
-	y.Check(err)
-	return res
-}
-
-func (t *Table) readIndex() error {
-	readPos := t.tableSize
+// readIndex reads and verifies the index at the end of the table, and decrypts it with the data key
+// from keys if the table is encrypted. See Builder.Finish for its layout. Tables without the magic
+// are read as tables of the legacy layout.
+func (t *Table) readIndex(keys DataKeys) error {
+	if t.tableSize < 4+len(tableMagic) {
+		return t.readLegacyIndex()
+	}
+	tail, err := t.read(t.tableSize-4-len(tableMagic), 4+len(tableMagic))
+	if err != nil {
+		return errors.Wrapf(err, "While reading footer of table: %s", t.Filename())
+	}
+	if !bytes.Equal(tail[4:], tableMagic[:]) {
+		return t.readLegacyIndex()
+	}
+	version := binary.BigEndian.Uint32(tail[:4])
+	size := footerSize
+	switch version {
+	case tableVersion:
+		if t.tableSize < size {
+			return errors.Wrapf(ErrCorruptTable, "%s: too small to hold a footer: %d bytes",
+				t.Filename(), t.tableSize)
+		}
+	case encryptedTableVersion:
+		size = encryptedFooterSize
+		if t.tableSize < size {
+			return errors.Wrapf(ErrCorruptTable, "%s: too small to hold a footer: %d bytes",
+				t.Filename(), t.tableSize)
+		}
+	default:
+		return errors.Wrapf(ErrUnsupportedVersion, "%s: version %d (we support %d and %d)",
+			t.Filename(), version, tableVersion, encryptedTableVersion)
+	}
+	footer, err := t.read(t.tableSize-size, size)
+	if err != nil {
+		return errors.Wrapf(err, "While reading footer of table: %s", t.Filename())
+	}
+	// The index length and the checksum come right before the version and the magic.
+	indexLen := int(binary.BigEndian.Uint32(footer[size-16:]))
+	checksum := binary.BigEndian.Uint32(footer[size-12:])
+	if indexLen > t.tableSize-size {
+		return errors.Wrapf(ErrCorruptTable, "%s: index length %d exceeds table size %d",
+			t.Filename(), indexLen, t.tableSize)
+	}
+	indexStart := t.tableSize - size - indexLen
+	data, err := t.read(indexStart, indexLen+size-16)
+	if err != nil {
+		return errors.Wrapf(err, "While reading index of table: %s", t.Filename())
+	}
+	if err := verifyChecksum(data, checksum); err != nil {
+		return errors.Wrapf(err, "%s: index", t.Filename())
+	}
+	t.version = version
+	t.props.decode(data[indexLen:])
+	if version == encryptedTableVersion {
+		id := binary.BigEndian.Uint64(data[indexLen+propertiesSize:])
+		iv := data[indexLen+propertiesSize+8 : indexLen+propertiesSize+8+y.IVSize]
+		if keys == nil {
+			return errors.Errorf("%s: encrypted with data key %d, but no keys were given",
+				t.Filename(), id)
+		}
+		if t.dataKey, err = keys.DataKey(id); err != nil {
+			return errors.Wrapf(err, "While opening table: %s", t.Filename())
+		}
+		// The data might be mmaped, so it's decrypted into a buffer of its own.
+		index := make([]byte, indexLen)
+		t.dataKey.XOR(index, data[:indexLen], iv)
+		data = index
+	}
+	data = data[:indexLen]
+	// The checksum matched, so whatever's wrong with the index from here on was written wrong.
+	corrupt := func(what string) error {
+		return errors.Wrapf(ErrCorruptTable, "%s: index has invalid %s", t.Filename(), what)
+	}
 
 	// Read bloom filter.
-	readPos -= 4
-	buf := t.readNoFail(readPos, 4)
-	bloomLen := int(binary.BigEndian.Uint32(buf))
+	readPos := len(data) - 4
+	if readPos < 0 {
+		return corrupt("bloom filter length")
+	}
+	bloomLen := int(binary.BigEndian.Uint32(data[readPos:]))
 	readPos -= bloomLen
-	data := t.readNoFail(readPos, bloomLen)
-	t.bf = bbloom.JSONUnmarshal(data)
+	if readPos < 0 {
+		return corrupt("bloom filter length")
+	}
+	if t.bf, err = decodeFilter(data[readPos : readPos+bloomLen]); err != nil {
+		return errors.Wrapf(err, "%s", t.Filename())
+	}
 
 	readPos -= 4
-	buf = t.readNoFail(readPos, 4)
-	restartsLen := int(binary.BigEndian.Uint32(buf))
+	if readPos < 0 {
+		return corrupt("number of blocks")
+	}
+	restartsLen := int(binary.BigEndian.Uint32(data[readPos:]))
 
 	readPos -= 4 * restartsLen
-	buf = t.readNoFail(readPos, 4*restartsLen)
+	if readPos < 0 || restartsLen == 0 {
+		return corrupt("number of blocks")
+	}
+	buf := data[readPos:]
 
 	offsets := make([]int, restartsLen)
 	for i := 0; i < restartsLen; i++ {
@@ -226,7 +363,11 @@ func (t *Table) readIndex() error {
 		buf = buf[4:]
 	}
 
-	// The last offset stores the end of the last block.
+	// The last offset stores the end of the last block, and so the start of the index.
+	if offsets[len(offsets)-1] != indexStart {
+		return corrupt("block offsets")
+	}
+	blockKeys := data[:readPos]
 	for i := 0; i < len(offsets); i++ {
 		var o int
 		if i == 0 {
@@ -234,68 +375,130 @@ func (t *Table) readIndex() error {
 		} else {
 			o = offsets[i-1]
 		}
+		if offsets[i] < o+t.trailerSize() {
+			return corrupt("block offsets")
+		}
 
+		if len(blockKeys) < 2 {
+			return corrupt("block keys")
+		}
+		klen := int(binary.BigEndian.Uint16(blockKeys[:2]))
+		if len(blockKeys) < 2+klen {
+			return corrupt("block keys")
+		}
 		ko := keyOffset{
+			key:    y.Safecopy(nil, blockKeys[2:2+klen]),
 			offset: o,
 			len:    offsets[i] - o,
 		}
+		blockKeys = blockKeys[2+klen:]
 		t.blockIndex = append(t.blockIndex, ko)
 	}
 
-	che := make(chan error, len(t.blockIndex))
-	blocks := make(chan int, len(t.blockIndex))
+	sort.Sort(byKey(t.blockIndex))
+	return nil
+}
 
-	for i := 0; i < len(t.blockIndex); i++ {
-		blocks <- i
+// readLegacyIndex reads the index of a table written before tables had a footer: the offsets at
+// which the blocks end, followed by their number, the JSON encoded bloom filter and its length.
+// Nothing of it is checksummed, so it's checked to make sense instead, to tell such tables apart
+// from truncated ones. The blocks have no trailer, and start with their first key in full.
+func (t *Table) readLegacyIndex() error {
+	corrupt := func(what string) error {
+		return errors.Wrapf(ErrCorruptTable,
+			"%s: bad magic, and invalid %s for a table of the legacy layout, the table might be "+
+				"truncated", t.Filename(), what)
+	}
+	read := func(off, sz int) ([]byte, error) {
+		buf, err := t.read(off, sz)
+		return buf, errors.Wrapf(err, "While reading index of table: %s", t.Filename())
 	}
 
-	for i := 0; i < 64; i++ { // Run 64 goroutines.
-		go func() {
-			var h header
-
-			for index := range blocks {
-				ko := &t.blockIndex[index]
-
-				offset := ko.offset
-				buf, err := t.read(offset, h.Size())
-				if err != nil {
-					che <- errors.Wrap(err, "While reading first header in block")
-					continue
-				}
-
-				h.Decode(buf)
-				y.AssertTruef(h.plen == 0, "Key offset: %+v, h.plen = %d", *ko, h.plen)
-
-				offset += h.Size()
-				buf = make([]byte, h.klen)
-				var out []byte
-				if out, err = t.read(offset, int(h.klen)); err != nil {
-					che <- errors.Wrap(err, "While reading first key in block")
-					continue
-				}
-				y.AssertTrue(len(buf) == copy(buf, out))
+	readPos := t.tableSize - 4
+	if readPos < 0 {
+		return corrupt("bloom filter length")
+	}
+	buf, err := read(readPos, 4)
+	if err != nil {
+		return err
+	}
+	bloomLen := int(binary.BigEndian.Uint32(buf))
+	readPos -= bloomLen
+	if readPos < 4 || bloomLen == 0 {
+		return corrupt("bloom filter length")
+	}
+	bloomPos := readPos
 
-				ko.key = buf
-				che <- nil
-			}
-		}()
+	readPos -= 4
+	if buf, err = read(readPos, 4); err != nil {
+		return err
+	}
+	restartsLen := int(binary.BigEndian.Uint32(buf))
+	readPos -= 4 * restartsLen
+	if readPos < 0 || restartsLen == 0 {
+		return corrupt("number of blocks")
+	}
+	if buf, err = read(readPos, 4*restartsLen); err != nil {
+		return err
+	}
+	offsets := make([]int, restartsLen)
+	for i := 0; i < restartsLen; i++ {
+		offsets[i] = int(binary.BigEndian.Uint32(buf[:4]))
+		buf = buf[4:]
+	}
+	// The last offset stores the end of the last block, and so the start of the index.
+	if offsets[len(offsets)-1] != readPos {
+		return corrupt("block offsets")
 	}
-	close(blocks) // to stop reading goroutines
 
-	var readError error
-	for i := 0; i < len(t.blockIndex); i++ {
-		if err := <-che; err != nil && readError == nil {
-			readError = err
+	var h header
+	for i := 0; i < len(offsets); i++ {
+		var o int
+		if i > 0 {
+			o = offsets[i-1]
 		}
-	}
-	if readError != nil {
-		return readError
+		if offsets[i] < o+h.Size() {
+			return corrupt("block offsets")
+		}
+		if buf, err = read(o, h.Size()); err != nil {
+			return err
+		}
+		h.Decode(buf)
+		if h.plen != 0 || o+h.Size()+int(h.klen) > offsets[i] {
+			return corrupt("block keys")
+		}
+		if buf, err = read(o+h.Size(), int(h.klen)); err != nil {
+			return err
+		}
+		t.blockIndex = append(t.blockIndex, keyOffset{
+			key:    y.Safecopy(nil, buf),
+			offset: o,
+			len:    offsets[i] - o,
+		})
 	}
 
+	if buf, err = read(bloomPos, bloomLen); err != nil {
+		return err
+	}
+	if buf[0] != bloomFormatJSON {
+		return corrupt("bloom filter")
+	}
+	if t.bf, err = decodeFilter(buf); err != nil {
+		return errors.Wrapf(err, "%s", t.Filename())
+	}
+	t.version = legacyTableVersion
 	sort.Sort(byKey(t.blockIndex))
 	return nil
 }
 
+// trailerSize returns the number of bytes which follow the data of each block.
+func (t *Table) trailerSize() int {
+	if t.dataKey != nil {
+		return y.IVSize + blockTrailerSize
+	}
+	return blockTrailerSize
+}
+
 func (t *Table) block(idx int) (block, error) {
 	y.AssertTruef(idx >= 0, "idx=%d", idx)
 	if idx >= len(t.blockIndex) {
@@ -306,14 +509,96 @@ func (t *Table) block(idx int) (block, error) {
 	blk := block{
 		offset: ko.offset,
 	}
-	var err error
-	blk.data, err = t.read(blk.offset, ko.len)
-	return blk, err
+	// Uncompressed blocks are used in place when the table is in memory, so only the blocks
+	// that would be read from disk, decrypted or decompressed again go through the cache.
+	key := cacheKey{tableID: t.id, idx: idx}
+	cacheable := t.cache != nil && (len(t.mmap) == 0 || t.dataKey != nil ||
+		(t.version != legacyTableVersion &&
+			t.mmap[ko.offset+ko.len-blockTrailerSize] != byte(options.None)))
+	if cacheable {
+		if data, ok := t.cache.get(key); ok {
+			blk.data = data
+			return blk, nil
+		}
+	}
+
+	data, err := t.read(blk.offset, ko.len)
+	if err != nil {
+		return block{}, err
+	}
+	if t.version == legacyTableVersion {
+		// The blocks of the legacy layout are neither checksummed, compressed nor encrypted.
+		blk.data = data
+		if cacheable {
+			t.cache.set(key, blk.data)
+		}
+		return blk, nil
+	}
+	// readIndex made sure the block is big enough to hold its trailer.
+	n := len(data) - checksumSize
+	if t.chkMode == options.OnBlockRead || t.chkMode == options.OnTableAndBlockRead {
+		if err := verifyChecksum(data[:n], binary.BigEndian.Uint32(data[n:])); err != nil {
+			return block{}, errors.Wrapf(err, "%s: block %d", t.Filename(), idx)
+		}
+	}
+	n -= compressionTypeSize
+	ct := options.CompressionType(data[n])
+	if t.dataKey != nil {
+		n -= y.IVSize
+		plain := make([]byte, n)
+		t.dataKey.XOR(plain, data[:n], data[n:n+y.IVSize])
+		data = plain
+	}
+	blk.data, err = decompress(ct, data[:n])
+	if err != nil {
+		return block{}, errors.Wrapf(err, "While decompressing block %d of table %d", idx, t.id)
+	}
+	if cacheable {
+		t.cache.set(key, blk.data)
+	}
+	return blk, nil
+}
+
+// VerifyChecksum verifies the checksums of all the blocks of the table. The index is always
+// verified when the table is opened.
+func (t *Table) VerifyChecksum() error {
+	for i := range t.blockIndex {
+		if _, _, err := t.VerifyBlock(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NumBlocks returns the number of blocks of the table.
+func (t *Table) NumBlocks() int { return len(t.blockIndex) }
+
+// VerifyBlock verifies the checksum of block idx, reading it from the file even if it's cached.
+// It returns the offset and the size of the block in the file. The blocks of tables of the legacy
+// layout have no checksum, and always pass.
+func (t *Table) VerifyBlock(idx int) (offset, size int, err error) {
+	ko := t.blockIndex[idx]
+	if t.version == legacyTableVersion {
+		return ko.offset, ko.len, nil
+	}
+	data, err := t.read(ko.offset, ko.len)
+	if err != nil {
+		return ko.offset, ko.len,
+			errors.Wrapf(err, "While reading block %d of table: %s", idx, t.Filename())
+	}
+	n := len(data) - checksumSize
+	if err := verifyChecksum(data[:n], binary.BigEndian.Uint32(data[n:])); err != nil {
+		return ko.offset, ko.len, errors.Wrapf(err, "%s: block %d", t.Filename(), idx)
+	}
+	return ko.offset, ko.len, nil
 }
 
 // Size is its file size in bytes
 func (t *Table) Size() int64 { return int64(t.tableSize) }
 
+// Properties returns the properties recorded in the footer of the table.
+func (t *Table) Properties() Properties { return t.props }
+
 // Smallest is its smallest key, or nil if there are none
 func (t *Table) Smallest() []byte { return t.smallest }
 
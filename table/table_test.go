@@ -17,14 +17,20 @@
 package table
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"sort"
 	"testing"
 
+	"github.com/AndreasBriese/bbloom"
 	"github.com/dgraph-io/badger/options"
 	"github.com/dgraph-io/badger/y"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -45,7 +51,12 @@ func buildTestTable(t *testing.T, prefix string, n int) *os.File {
 
 // keyValues is n by 2 where n is number of pairs.
 func buildTable(t *testing.T, keyValues [][]string) *os.File {
-	b := NewTableBuilder()
+	return buildTableWithCompression(t, keyValues, options.None)
+}
+
+func buildTableWithCompression(t *testing.T, keyValues [][]string,
+	compression options.CompressionType) *os.File {
+	b := NewTableBuilder(compression, 0.01, nil)
 	defer b.Close()
 	// TODO: Add test for file garbage collection here. No files should be left after the tests here.
 
@@ -69,7 +80,13 @@ func buildTable(t *testing.T, keyValues [][]string) *os.File {
 			y.Check(err)
 		}
 	}
-	f.Write(b.Finish())
+	data, err := b.Finish()
+	if t != nil {
+		require.NoError(t, err)
+	} else {
+		y.Check(err)
+	}
+	f.Write(data)
 	f.Close()
 	f, _ = y.OpenSyncedFile(filename, true)
 	return f
@@ -79,7 +96,7 @@ func TestSeekToFirst(t *testing.T) {
 	for _, n := range []int{101, 199, 200, 250, 9999, 10000} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
 			f := buildTestTable(t, "key", n)
-			table, err := OpenTable(f, options.MemoryMap)
+			table, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 			require.NoError(t, err)
 			defer table.DecrRef()
 			it := table.NewIterator(false)
@@ -97,7 +114,7 @@ func TestSeekToLast(t *testing.T) {
 	for _, n := range []int{101, 199, 200, 250, 9999, 10000} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
 			f := buildTestTable(t, "key", n)
-			table, err := OpenTable(f, options.MemoryMap)
+			table, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 			require.NoError(t, err)
 			defer table.DecrRef()
 			it := table.NewIterator(false)
@@ -118,7 +135,7 @@ func TestSeekToLast(t *testing.T) {
 
 func TestSeek(t *testing.T) {
 	f := buildTestTable(t, "k", 10000)
-	table, err := OpenTable(f, options.MemoryMap)
+	table, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer table.DecrRef()
 
@@ -153,7 +170,7 @@ func TestSeek(t *testing.T) {
 
 func TestSeekForPrev(t *testing.T) {
 	f := buildTestTable(t, "k", 10000)
-	table, err := OpenTable(f, options.MemoryMap)
+	table, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer table.DecrRef()
 
@@ -191,7 +208,7 @@ func TestIterateFromStart(t *testing.T) {
 	for _, n := range []int{101, 199, 200, 250, 9999, 10000} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
 			f := buildTestTable(t, "key", n)
-			table, err := OpenTable(f, options.MemoryMap)
+			table, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 			require.NoError(t, err)
 			defer table.DecrRef()
 			ti := table.NewIterator(false)
@@ -218,7 +235,7 @@ func TestIterateFromEnd(t *testing.T) {
 	for _, n := range []int{101, 199, 200, 250, 9999, 10000} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
 			f := buildTestTable(t, "key", n)
-			table, err := OpenTable(f, options.FileIO)
+			table, err := OpenTable(f, options.FileIO, options.OnTableAndBlockRead, nil, nil)
 			require.NoError(t, err)
 			defer table.DecrRef()
 			ti := table.NewIterator(false)
@@ -241,7 +258,7 @@ func TestIterateFromEnd(t *testing.T) {
 
 func TestTable(t *testing.T) {
 	f := buildTestTable(t, "key", 10000)
-	table, err := OpenTable(f, options.FileIO)
+	table, err := OpenTable(f, options.FileIO, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer table.DecrRef()
 	ti := table.NewIterator(false)
@@ -266,9 +283,442 @@ func TestTable(t *testing.T) {
 	require.EqualValues(t, string(y.ParseKey(k)), key("key", 0))
 }
 
+func TestCompression(t *testing.T) {
+	keyValues := make([][]string, 10000)
+	for i := range keyValues {
+		keyValues[i] = []string{key("key", i), fmt.Sprintf("%0100d", i)}
+	}
+	f := buildTableWithCompression(t, keyValues, options.None)
+	uncompressed, err := OpenTable(f, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
+	require.NoError(t, err)
+	defer uncompressed.DecrRef()
+
+	for _, ct := range []options.CompressionType{options.Snappy, options.ZSTD} {
+		for _, mode := range []options.FileLoadingMode{options.FileIO, options.MemoryMap} {
+			t.Run(fmt.Sprintf("compression=%d,mode=%d", ct, mode), func(t *testing.T) {
+				f := buildTableWithCompression(t, keyValues, ct)
+				table, err := OpenTable(f, mode, options.OnTableAndBlockRead, nil, nil)
+				require.NoError(t, err)
+				defer table.DecrRef()
+				require.True(t, table.Size() < uncompressed.Size()/2,
+					"compressed: %d, uncompressed: %d", table.Size(), uncompressed.Size())
+
+				it := table.NewIterator(false)
+				defer it.Close()
+				var count int
+				for it.Rewind(); it.Valid(); it.Next() {
+					require.EqualValues(t, keyValues[count][0], y.ParseKey(it.Key()))
+					require.EqualValues(t, keyValues[count][1], it.Value().Value)
+					count++
+				}
+				require.Equal(t, len(keyValues), count)
+
+				it.Seek(y.KeyWithTs([]byte(key("key", 5555)), 0))
+				require.True(t, it.Valid())
+				require.EqualValues(t, key("key", 5555), y.ParseKey(it.Key()))
+			})
+		}
+	}
+}
+
+func TestCompressionMixedBlocks(t *testing.T) {
+	b := NewTableBuilder(options.ZSTD, 0.01, nil)
+	defer b.Close()
+	for i := 0; i < 1000; i++ {
+		if i%restartInterval == 0 {
+			// Each block records its own algorithm.
+			b.compression = options.CompressionType(i / restartInterval % 3)
+		}
+		require.NoError(t, b.Add(y.KeyWithTs([]byte(key("key", i)), 0),
+			y.ValueStruct{Value: []byte(fmt.Sprintf("%050d", i))}))
+	}
+
+	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	data, err := b.Finish()
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	table, err := OpenTable(f, options.FileIO, options.OnTableAndBlockRead, nil, nil)
+	require.NoError(t, err)
+	defer table.DecrRef()
+
+	it := table.NewIterator(true)
+	defer it.Close()
+	i := 999
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.EqualValues(t, key("key", i), y.ParseKey(it.Key()))
+		require.EqualValues(t, fmt.Sprintf("%050d", i), it.Value().Value)
+		i--
+	}
+	require.Equal(t, -1, i)
+}
+
+type testDataKeys map[uint64]*y.DataKey
+
+func (keys testDataKeys) DataKey(id uint64) (*y.DataKey, error) {
+	dk, ok := keys[id]
+	if !ok {
+		return nil, errors.Errorf("Unknown data key: %d", id)
+	}
+	return dk, nil
+}
+
+func TestEncryptedTable(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	dk, err := y.NewDataKey(7, secret)
+	require.NoError(t, err)
+	b := NewTableBuilder(options.Snappy, 0.01, dk)
+	defer b.Close()
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, b.Add(y.KeyWithTs([]byte(key("secretkey", i)), 0),
+			y.ValueStruct{Value: []byte(fmt.Sprintf("secretvalue%05d", i))}))
+	}
+	data, err := b.Finish()
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(data, []byte("secret")))
+
+	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+	defer os.Remove(filename)
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+
+	for _, mode := range []options.FileLoadingMode{
+		options.FileIO, options.LoadToRAM, options.MemoryMap} {
+		table, err := OpenTable(f, mode, options.OnTableAndBlockRead, NewCache(1<<20),
+			testDataKeys{dk.ID: dk})
+		require.NoError(t, err)
+		it := table.NewIterator(false)
+		i := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.EqualValues(t, key("secretkey", i), y.ParseKey(it.Key()))
+			require.EqualValues(t, fmt.Sprintf("secretvalue%05d", i), it.Value().Value)
+			i++
+		}
+		it.Close()
+		require.Equal(t, 1000, i)
+		require.False(t, table.DoesNotHave([]byte(key("secretkey", 500))))
+		require.True(t, table.DoesNotHave([]byte("nosuchkey")))
+		require.NoError(t, table.VerifyChecksum())
+		require.NoError(t, table.Close())
+		f, err = y.OpenSyncedFile(filename, true)
+		require.NoError(t, err)
+	}
+
+	// The table can't be read without its data key.
+	_, err = OpenTable(f, options.FileIO, options.NoVerification, nil, testDataKeys{})
+	require.Error(t, err)
+	_, err = OpenTable(f, options.FileIO, options.NoVerification, nil, nil)
+	require.Error(t, err)
+}
+
+// flipByte flips the bits of the byte at offset off of the file, and returns the file opened.
+func flipByte(t *testing.T, filename string, off int64) *os.File {
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	var b [1]byte
+	_, err = f.ReadAt(b[:], off)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b[:], off)
+	require.NoError(t, err)
+	return f
+}
+
+func TestChecksum(t *testing.T) {
+	f := buildTestTable(t, "key", 10000)
+	filename := f.Name()
+	defer os.Remove(filename)
+	table, err := OpenTable(f, options.FileIO, options.NoVerification, nil, nil)
+	require.NoError(t, err)
+	blockOffset := int64(table.blockIndex[5].offset)
+	require.NoError(t, table.Close())
+
+	// A corrupt block goes unnoticed at open, unless all the blocks are verified.
+	f = flipByte(t, filename, blockOffset+20)
+	table, err = OpenTable(f, options.FileIO, options.OnTableRead, nil, nil)
+	require.Error(t, err)
+	require.Equal(t, ErrChecksumMismatch, errors.Cause(err))
+
+	f, err = y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	table, err = OpenTable(f, options.FileIO, options.OnBlockRead, nil, nil)
+	require.NoError(t, err)
+	it := table.NewIterator(false)
+	var count int
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	require.Equal(t, 5*restartInterval, count)
+	require.Equal(t, ErrChecksumMismatch, errors.Cause(it.Error()))
+	require.NoError(t, it.Close())
+
+	// The blocks can be verified one at a time.
+	require.True(t, table.NumBlocks() > 5)
+	_, _, err = table.VerifyBlock(4)
+	require.NoError(t, err)
+	off, _, err := table.VerifyBlock(5)
+	require.Equal(t, ErrChecksumMismatch, errors.Cause(err))
+	require.Equal(t, blockOffset, int64(off))
+	require.NoError(t, table.Close())
+
+	// A corrupt index is always detected.
+	fi, err := os.Stat(filename)
+	require.NoError(t, err)
+	f = flipByte(t, filename, fi.Size()-int64(footerSize)-10)
+	_, err = OpenTable(f, options.FileIO, options.NoVerification, nil, nil)
+	require.Error(t, err)
+	require.Equal(t, ErrChecksumMismatch, errors.Cause(err))
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(cacheShards * 100)
+	key := func(i int) cacheKey { return cacheKey{tableID: 1, idx: i * cacheShards} }
+	for i := 0; i < 3; i++ {
+		c.set(key(i), make([]byte, 40)) // All on the same shard.
+	}
+	_, ok := c.get(key(0))
+	require.False(t, ok, "the least recently used block should've been evicted")
+	_, ok = c.get(key(1))
+	require.True(t, ok)
+	c.set(key(3), make([]byte, 40))
+	_, ok = c.get(key(2))
+	require.False(t, ok)
+	_, ok = c.get(key(1))
+	require.True(t, ok)
+
+	c.set(key(4), make([]byte, 101)) // Too big to cache.
+	_, ok = c.get(key(4))
+	require.False(t, ok)
+
+	c.dropTable(1, 4*cacheShards)
+	_, ok = c.get(key(1))
+	require.False(t, ok)
+	_, ok = c.get(key(3))
+	require.False(t, ok)
+
+	var nilCache *Cache
+	nilCache.set(key(0), []byte("abc"))
+	_, ok = nilCache.get(key(0))
+	require.False(t, ok)
+}
+
+func TestBlockCache(t *testing.T) {
+	c := NewCache(1 << 20)
+	f := buildTestTable(t, "key", 10000)
+	table, err := OpenTable(f, options.FileIO, options.NoVerification, c, nil)
+	require.NoError(t, err)
+
+	iterate := func() {
+		it := table.NewIterator(false)
+		defer it.Close()
+		var count int
+		for it.Rewind(); it.Valid(); it.Next() {
+			count++
+		}
+		require.Equal(t, 10000, count)
+	}
+	iterate()
+	hits, misses, reads := y.NumBlockCacheHits.Value(), y.NumBlockCacheMisses.Value(),
+		y.NumReads.Value()
+	iterate()
+	require.True(t, y.NumBlockCacheHits.Value() >= hits+int64(len(table.blockIndex)))
+	require.Equal(t, misses, y.NumBlockCacheMisses.Value())
+	require.Equal(t, reads, y.NumReads.Value(), "all the blocks should be read from the cache")
+
+	// Deleting the table evicts its blocks.
+	id, numBlocks := table.ID(), len(table.blockIndex)
+	require.NoError(t, table.DecrRef())
+	for i := 0; i < numBlocks; i++ {
+		_, ok := c.get(cacheKey{tableID: id, idx: i})
+		require.False(t, ok)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	for _, fp := range []float64{0.1, 0.01, 0.001} {
+		t.Run(fmt.Sprintf("fp=%v", fp), func(t *testing.T) {
+			var hashes []uint32
+			for i := 0; i < 10000; i++ {
+				hashes = append(hashes, bloomHash([]byte(key("key", i))))
+			}
+			bf := newBloomFilter(hashes, bloomBitsPerKey(fp))
+			for i := 0; i < 10000; i++ {
+				require.True(t, bf.Has([]byte(key("key", i))))
+			}
+			var falsePositives int
+			for i := 0; i < 10000; i++ {
+				if bf.Has([]byte(key("other", i))) {
+					falsePositives++
+				}
+			}
+			require.True(t, float64(falsePositives)/10000 < 2*fp,
+				"false positives: %d", falsePositives)
+		})
+	}
+}
+
+// withJSONBloom rewrites the bloom filter of the table as JSON, the way tables used to be
+// written.
+func withJSONBloom(data []byte, keys []string) []byte {
+	bf := bbloom.New(float64(len(keys)), 0.01)
+	for _, k := range keys {
+		bf.Add([]byte(k))
+	}
+	jsonData := bf.JSONMarshal()
+
+	footer := data[len(data)-footerSize:]
+	end := len(data) - footerSize
+	indexStart := end - int(binary.BigEndian.Uint32(footer[propertiesSize:]))
+	bloomLen := int(binary.BigEndian.Uint32(data[end-4:]))
+	out := append([]byte{}, data[:end-4-bloomLen]...)
+	out = append(out, jsonData...)
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(len(jsonData)))
+	out = append(out, buf[:]...)
+	indexLen := len(out) - indexStart
+	out = append(out, footer[:propertiesSize]...)
+	checksum := crc32.Checksum(out[indexStart:], y.CastagnoliCrcTable)
+	binary.BigEndian.PutUint32(buf[:], uint32(indexLen))
+	out = append(out, buf[:]...)
+	binary.BigEndian.PutUint32(buf[:], checksum)
+	out = append(out, buf[:]...)
+	return append(out, footer[propertiesSize+8:]...)
+}
+
+func TestJSONBloomFilter(t *testing.T) {
+	b := NewTableBuilder(options.None, 0.01, nil)
+	defer b.Close()
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, key("key", i))
+		require.NoError(t, b.Add(y.KeyWithTs([]byte(keys[i]), 0), y.ValueStruct{Value: []byte("v")}))
+	}
+
+	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+	data, err := b.Finish()
+	require.NoError(t, err)
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	_, err = f.Write(withJSONBloom(data, keys))
+	require.NoError(t, err)
+	table, err := OpenTable(f, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
+	require.NoError(t, err)
+	defer table.DecrRef()
+
+	_, ok := table.bf.(bbloom.Bloom)
+	require.True(t, ok)
+	for _, k := range keys {
+		require.False(t, table.DoesNotHave([]byte(k)))
+	}
+	require.True(t, table.DoesNotHave([]byte("nonexistent")))
+}
+
+// testdata/baseline.sst was written before tables had a footer, by
+// buildTestTable(t, "key", 250). It has three blocks and a JSON bloom filter.
+func TestLegacyTable(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/baseline.sst")
+	require.NoError(t, err)
+	for _, mode := range []options.FileLoadingMode{options.LoadToRAM, options.MemoryMap,
+		options.FileIO} {
+		filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+		f, err := y.OpenSyncedFile(filename, true)
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+		table, err := OpenTable(f, mode, options.OnTableAndBlockRead, NewCache(1<<20), nil)
+		require.NoError(t, err)
+
+		require.EqualValues(t, legacyTableVersion, table.version)
+		require.Equal(t, 3, table.NumBlocks())
+		require.NoError(t, table.VerifyChecksum())
+		require.Equal(t, Properties{}, table.Properties())
+		_, ok := table.bf.(bbloom.Bloom)
+		require.True(t, ok)
+		require.Equal(t, key("key", 0), string(y.ParseKey(table.Smallest())))
+		require.Equal(t, key("key", 249), string(y.ParseKey(table.Biggest())))
+		for i := 0; i < 250; i++ {
+			require.False(t, table.DoesNotHave([]byte(key("key", i))))
+		}
+		require.True(t, table.DoesNotHave([]byte("nonexistent")))
+
+		it := table.NewIterator(false)
+		var n int
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.Equal(t, key("key", n), string(y.ParseKey(it.Key())))
+			v := it.Value()
+			require.Equal(t, y.ValueStruct{Meta: 'A', Value: []byte(fmt.Sprintf("%d", n))}, v)
+			n++
+		}
+		require.NoError(t, it.Error())
+		require.Equal(t, 250, n)
+		it.Seek(y.KeyWithTs([]byte(key("key", 150)), 0))
+		require.True(t, it.Valid())
+		require.Equal(t, "150", string(it.Value().Value))
+		require.NoError(t, it.Close())
+
+		rit := table.NewIterator(true)
+		rit.Seek(y.KeyWithTs([]byte(key("key", 99)), 0))
+		require.True(t, rit.Valid())
+		require.Equal(t, "99", string(rit.Value().Value))
+		rit.Next()
+		require.True(t, rit.Valid())
+		require.Equal(t, "98", string(rit.Value().Value))
+		require.NoError(t, rit.Close())
+		require.NoError(t, table.DecrRef())
+	}
+}
+
+func TestTableProperties(t *testing.T) {
+	b := NewTableBuilder(options.Snappy, 0.01, nil)
+	defer b.Close()
+	for i := 0; i < 1000; i++ {
+		vs := y.ValueStruct{Value: []byte(fmt.Sprintf("%050d", i))}
+		if i%10 == 0 {
+			vs = y.ValueStruct{Meta: bitDelete}
+		}
+		require.NoError(t, b.Add(y.KeyWithTs([]byte(key("key", i)), uint64(i%100+5)), vs))
+	}
+	data, err := b.Finish()
+	require.NoError(t, err)
+	data = append([]byte{}, data...)
+
+	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+	defer os.Remove(filename)
+	writeTable := func(data []byte) *os.File {
+		f, err := y.OpenTruncFile(filename, true)
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+		return f
+	}
+
+	table, err := OpenTable(writeTable(data), options.LoadToRAM, options.NoVerification, nil, nil)
+	require.NoError(t, err)
+	props := table.Properties()
+	require.NoError(t, table.Close())
+	require.Equal(t, uint64(1000), props.KeyCount)
+	require.Equal(t, uint64(100), props.TombstoneCount)
+	require.Equal(t, uint64(5), props.MinVersion)
+	require.Equal(t, uint64(104), props.MaxVersion)
+	require.True(t, props.OnDiskSize < props.RawSize, "%+v", props)
+
+	// A truncated table is told apart from a table of a version we don't know.
+	_, err = OpenTable(writeTable(data[:len(data)-100]), options.LoadToRAM,
+		options.NoVerification, nil, nil)
+	require.Equal(t, ErrCorruptTable, errors.Cause(err))
+	binary.BigEndian.PutUint32(data[len(data)-8:], encryptedTableVersion+1)
+	_, err = OpenTable(writeTable(data), options.LoadToRAM, options.NoVerification, nil, nil)
+	require.Equal(t, ErrUnsupportedVersion, errors.Cause(err))
+}
+
 func TestIterateBackAndForth(t *testing.T) {
 	f := buildTestTable(t, "key", 10000)
-	table, err := OpenTable(f, options.MemoryMap)
+	table, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer table.DecrRef()
 
@@ -309,7 +759,7 @@ func TestIterateBackAndForth(t *testing.T) {
 
 func TestUniIterator(t *testing.T) {
 	f := buildTestTable(t, "key", 10000)
-	table, err := OpenTable(f, options.MemoryMap)
+	table, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer table.DecrRef()
 	{
@@ -345,7 +795,7 @@ func TestConcatIteratorOneTable(t *testing.T) {
 		{"k2", "a2"},
 	})
 
-	tbl, err := OpenTable(f, options.MemoryMap)
+	tbl, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer tbl.DecrRef()
 
@@ -365,13 +815,13 @@ func TestConcatIterator(t *testing.T) {
 	f := buildTestTable(t, "keya", 10000)
 	f2 := buildTestTable(t, "keyb", 10000)
 	f3 := buildTestTable(t, "keyc", 10000)
-	tbl, err := OpenTable(f, options.MemoryMap)
+	tbl, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer tbl.DecrRef()
-	tbl2, err := OpenTable(f2, options.LoadToRAM)
+	tbl2, err := OpenTable(f2, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer tbl2.DecrRef()
-	tbl3, err := OpenTable(f3, options.LoadToRAM)
+	tbl3, err := OpenTable(f3, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer tbl3.DecrRef()
 
@@ -450,10 +900,10 @@ func TestMergingIterator(t *testing.T) {
 		{"k1", "b1"},
 		{"k2", "b2"},
 	})
-	tbl1, err := OpenTable(f1, options.LoadToRAM)
+	tbl1, err := OpenTable(f1, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer tbl1.DecrRef()
-	tbl2, err := OpenTable(f2, options.LoadToRAM)
+	tbl2, err := OpenTable(f2, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer tbl2.DecrRef()
 	it1 := tbl1.NewIterator(false)
@@ -490,10 +940,10 @@ func TestMergingIteratorReversed(t *testing.T) {
 		{"k1", "b1"},
 		{"k2", "b2"},
 	})
-	tbl1, err := OpenTable(f1, options.LoadToRAM)
+	tbl1, err := OpenTable(f1, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer tbl1.DecrRef()
-	tbl2, err := OpenTable(f2, options.LoadToRAM)
+	tbl2, err := OpenTable(f2, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer tbl2.DecrRef()
 	it1 := tbl1.NewIterator(true)
@@ -529,10 +979,10 @@ func TestMergingIteratorTakeOne(t *testing.T) {
 	})
 	f2 := buildTable(t, [][]string{})
 
-	t1, err := OpenTable(f1, options.LoadToRAM)
+	t1, err := OpenTable(f1, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer t1.DecrRef()
-	t2, err := OpenTable(f2, options.LoadToRAM)
+	t2, err := OpenTable(f2, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer t2.DecrRef()
 
@@ -569,10 +1019,10 @@ func TestMergingIteratorTakeTwo(t *testing.T) {
 		{"k2", "a2"},
 	})
 
-	t1, err := OpenTable(f1, options.LoadToRAM)
+	t1, err := OpenTable(f1, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer t1.DecrRef()
-	t2, err := OpenTable(f2, options.LoadToRAM)
+	t2, err := OpenTable(f2, options.LoadToRAM, options.OnTableAndBlockRead, nil, nil)
 	require.NoError(t, err)
 	defer t2.DecrRef()
 
@@ -603,7 +1053,7 @@ func TestMergingIteratorTakeTwo(t *testing.T) {
 
 func BenchmarkRead(b *testing.B) {
 	n := 5 << 20
-	builder := NewTableBuilder()
+	builder := NewTableBuilder(options.None, 0.01, nil)
 	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
 	f, err := y.OpenSyncedFile(filename, true)
 	y.Check(err)
@@ -613,8 +1063,10 @@ func BenchmarkRead(b *testing.B) {
 		y.Check(builder.Add([]byte(k), y.ValueStruct{Value: []byte(v), Meta: 123, UserMeta: 0}))
 	}
 
-	f.Write(builder.Finish())
-	tbl, err := OpenTable(f, options.MemoryMap)
+	data, err := builder.Finish()
+	y.Check(err)
+	f.Write(data)
+	tbl, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 	y.Check(err)
 	defer tbl.DecrRef()
 
@@ -633,7 +1085,7 @@ func BenchmarkRead(b *testing.B) {
 
 func BenchmarkReadAndBuild(b *testing.B) {
 	n := 5 << 20
-	builder := NewTableBuilder()
+	builder := NewTableBuilder(options.None, 0.01, nil)
 	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
 	f, err := y.OpenSyncedFile(filename, true)
 	y.Check(err)
@@ -643,8 +1095,10 @@ func BenchmarkReadAndBuild(b *testing.B) {
 		y.Check(builder.Add([]byte(k), y.ValueStruct{Value: []byte(v), Meta: 123, UserMeta: 0}))
 	}
 
-	f.Write(builder.Finish())
-	tbl, err := OpenTable(f, options.MemoryMap)
+	data, err := builder.Finish()
+	y.Check(err)
+	f.Write(data)
+	tbl, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 	y.Check(err)
 	defer tbl.DecrRef()
 
@@ -653,14 +1107,15 @@ func BenchmarkReadAndBuild(b *testing.B) {
 	// Iterate b.N times over the entire table.
 	for i := 0; i < b.N; i++ {
 		func() {
-			newBuilder := NewTableBuilder()
+			newBuilder := NewTableBuilder(options.None, 0.01, nil)
 			it := tbl.NewIterator(false)
 			defer it.Close()
 			for it.seekToFirst(); it.Valid(); it.next() {
 				vs := it.Value()
 				newBuilder.Add(it.Key(), vs)
 			}
-			newBuilder.Finish()
+			_, err := newBuilder.Finish()
+			y.Check(err)
 		}()
 	}
 }
@@ -673,7 +1128,7 @@ func BenchmarkReadMerged(b *testing.B) {
 	var tables []*Table
 	for i := 0; i < m; i++ {
 		filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
-		builder := NewTableBuilder()
+		builder := NewTableBuilder(options.None, 0.01, nil)
 		f, err := y.OpenSyncedFile(filename, true)
 		for j := 0; j < tableSize; j++ {
 			id := j*m + i // Arrays are interleaved.
@@ -682,8 +1137,10 @@ func BenchmarkReadMerged(b *testing.B) {
 			v := fmt.Sprintf("%d", id)
 			y.Check(builder.Add([]byte(k), y.ValueStruct{Value: []byte(v), Meta: 123, UserMeta: 0}))
 		}
-		f.Write(builder.Finish())
-		tbl, err := OpenTable(f, options.MemoryMap)
+		data, err := builder.Finish()
+		y.Check(err)
+		f.Write(data)
+		tbl, err := OpenTable(f, options.MemoryMap, options.OnTableAndBlockRead, nil, nil)
 		y.Check(err)
 		tables = append(tables, tbl)
 		defer tbl.DecrRef()
@@ -21,9 +21,11 @@ import (
 	"container/heap"
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/badger/y"
 	farm "github.com/dgryski/go-farm"
@@ -60,6 +62,50 @@ type oracle struct {
 	// refCount is used to clear out commits map to avoid a memory blowup.
 	commits  map[uint64]uint64
 	refCount int64
+
+	// committed stores the keys written by each commit, so range reads can be checked against
+	// them. The keys are only recorded while another update txn is pending, and are dropped once
+	// no pending txn reads below their commit, or along with commits.
+	committed []committedTxn
+	// updateTxns counts the pending update txns, which are counted before they get their read
+	// timestamp. inFlight holds the writes of the commits which weren't recorded and aren't done
+	// yet, which an update txn starting meanwhile might read below. In managed mode, where txns
+	// pick their read timestamp, untrackedTs is the latest commit whose keys weren't recorded
+	// instead, which the txns reading below it can't check their ranges against.
+	updateTxns  int
+	inFlight    map[uint64]map[string]*entry
+	untrackedTs uint64
+
+	// readMarks counts the transactions that haven't been discarded yet, by their read
+	// timestamp. Compactions use it to find the versions no reader can see anymore. It's not used
+	// in managed mode, where the user sets discardTs instead.
+	readMu    sync.Mutex
+	readMarks map[uint64]int
+	discardTs uint64 // Atomic.
+}
+
+// committedTxn holds the keys written by a transaction, sorted, and its commit timestamp.
+type committedTxn struct {
+	ts   uint64
+	keys []string
+}
+
+// readRange is a range of keys scanned by an iterator, with both ends inclusive. A nil start or
+// end means the range is unbounded on that side.
+type readRange struct {
+	start, end []byte
+}
+
+// overlaps returns true if any of the sorted keys lies within r.
+func (r readRange) overlaps(keys []string) bool {
+	idx := 0
+	if r.start != nil {
+		idx = sort.SearchStrings(keys, string(r.start))
+	}
+	if idx == len(keys) {
+		return false
+	}
+	return r.end == nil || keys[idx] <= string(r.end)
 }
 
 func (o *oracle) addRef() {
@@ -75,6 +121,7 @@ func (o *oracle) decrRef() {
 		if len(o.commits) >= 1000 { // If the map is still small, let it slide.
 			o.commits = make(map[uint64]uint64)
 		}
+		o.committed = nil
 		o.Unlock()
 	}
 }
@@ -86,6 +133,114 @@ func (o *oracle) readTs() uint64 {
 	return atomic.LoadUint64(&o.curRead)
 }
 
+// startRead returns the read timestamp for a new transaction, and marks it as in use until
+// doneRead is called.
+func (o *oracle) startRead() uint64 {
+	if o.isManaged {
+		return o.readTs()
+	}
+	o.readMu.Lock()
+	defer o.readMu.Unlock()
+	// Load curRead under the lock, so that discardAtOrBelow either sees the mark, or returns a
+	// timestamp no higher than the one read here.
+	ts := o.readTs()
+	o.readMarks[ts]++
+	return ts
+}
+
+// markRead marks ts as in use until doneRead is called.
+func (o *oracle) markRead(ts uint64) {
+	if o.isManaged {
+		return
+	}
+	o.readMu.Lock()
+	defer o.readMu.Unlock()
+	o.readMarks[ts]++
+}
+
+func (o *oracle) doneRead(ts uint64) {
+	if o.isManaged {
+		return
+	}
+	o.readMu.Lock()
+	defer o.readMu.Unlock()
+	if o.readMarks[ts]--; o.readMarks[ts] <= 0 {
+		delete(o.readMarks, ts)
+	}
+}
+
+// discardAtOrBelow returns the timestamp at or below which only the latest version of each key
+// can be read by any current or future transaction.
+func (o *oracle) discardAtOrBelow() uint64 {
+	if o.isManaged {
+		return atomic.LoadUint64(&o.discardTs)
+	}
+	o.readMu.Lock()
+	defer o.readMu.Unlock()
+	min := o.readTs()
+	for ts := range o.readMarks {
+		if ts < min {
+			min = ts
+		}
+	}
+	return min
+}
+
+// startUpdate returns the read timestamp for a new update txn, like startRead. The keys of all
+// the commits the txn has to be checked against are recorded: those of the commits still in
+// flight now, and those of all the later ones, until doneUpdate is called.
+func (o *oracle) startUpdate() uint64 {
+	o.Lock()
+	defer o.Unlock()
+	o.updateTxns++
+	readTs := o.startRead()
+	var recorded bool
+	for ts, writes := range o.inFlight {
+		if ts > readTs {
+			o.committed = append(o.committed, committedTxn{ts: ts, keys: sortedKeys(writes)})
+			delete(o.inFlight, ts)
+			recorded = true
+		}
+	}
+	if recorded {
+		sort.Slice(o.committed, func(i, j int) bool {
+			return o.committed[i].ts < o.committed[j].ts
+		})
+	}
+	return readTs
+}
+
+func (o *oracle) doneUpdate() {
+	o.Lock()
+	defer o.Unlock()
+	o.updateTxns--
+}
+
+// sortedKeys returns the keys written by a txn, sorted.
+func sortedKeys(writes map[string]*entry) []string {
+	keys := make([]string, 0, len(writes))
+	for k := range writes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pruneCommitted drops the keys of the commits no pending or future txn reads below, which can't
+// conflict with any of them anymore. Must be called while having a lock.
+func (o *oracle) pruneCommitted() {
+	if o.isManaged || len(o.committed) == 0 {
+		// Managed txns read at any timestamp, so their commits are only dropped along with commits.
+		return
+	}
+	discardTs := o.discardAtOrBelow()
+	// Commits are appended in increasing order of ts.
+	i := sort.Search(len(o.committed), func(i int) bool {
+		return o.committed[i].ts > discardTs
+	})
+	o.committed = o.committed[i:]
+}
+
 func (o *oracle) commitTs() uint64 {
 	o.Lock()
 	defer o.Unlock()
@@ -94,7 +249,7 @@ func (o *oracle) commitTs() uint64 {
 
 // hasConflict must be called while having a lock.
 func (o *oracle) hasConflict(txn *Txn) bool {
-	if len(txn.reads) == 0 {
+	if len(txn.reads) == 0 && len(txn.readRanges) == 0 {
 		return false
 	}
 	for _, ro := range txn.reads {
@@ -102,6 +257,28 @@ func (o *oracle) hasConflict(txn *Txn) bool {
 			return true
 		}
 	}
+	if len(txn.readRanges) == 0 {
+		return false
+	}
+	if txn.rangesUnchecked {
+		// Some of the commits since txn started might have written into its ranges.
+		return true
+	}
+	// Commits are appended in increasing order of ts, unless the txns are managed.
+	for i := len(o.committed) - 1; i >= 0; i-- {
+		ct := o.committed[i]
+		if ct.ts <= txn.readTs {
+			if o.isManaged {
+				continue
+			}
+			break
+		}
+		for _, r := range txn.readRanges {
+			if r.overlaps(ct.keys) {
+				return true
+			}
+		}
+	}
 	return false
 }
 
@@ -127,6 +304,18 @@ func (o *oracle) newCommitTs(txn *Txn) uint64 {
 	for _, w := range txn.writes {
 		o.commits[w] = ts // Update the commitTs.
 	}
+	switch {
+	case len(txn.writes) == 0:
+	case o.updateTxns > 1:
+		// Some other update txn is pending, txn itself being one.
+		o.committed = append(o.committed, committedTxn{ts: ts, keys: sortedKeys(txn.pendingWrites)})
+	case !o.isManaged:
+		// The writes aren't changed anymore once txn commits.
+		o.inFlight[ts] = txn.pendingWrites
+	case ts > o.untrackedTs:
+		o.untrackedTs = ts
+	}
+	o.pruneCommitted()
 	if o.isManaged {
 		// No need to update the heap.
 		return ts
@@ -151,6 +340,7 @@ func (o *oracle) doneCommit(cts uint64) {
 		panic(fmt.Sprintf("We should already have the commit ts: %d", cts))
 	}
 	delete(o.pendingCommits, cts)
+	delete(o.inFlight, cts)
 
 	var min uint64
 	for len(o.commitMark) > 0 {
@@ -174,11 +364,19 @@ type Txn struct {
 	readTs   uint64
 	commitTs uint64
 
-	update bool     // update is used to conditionally keep track of reads.
-	reads  []uint64 // contains fingerprints of keys read.
-	writes []uint64 // contains fingerprints of keys written.
+	update      bool        // update is used to conditionally keep track of reads.
+	reads       []uint64    // contains fingerprints of keys read.
+	readRanges  []readRange // contains key ranges scanned by iterators.
+	writes      []uint64    // contains fingerprints of keys written.
+	noConflicts bool        // Set for WriteBatch txns, which don't take part in conflict detection.
+
+	// rangesUnchecked is set for a managed txn reading below some commit whose keys weren't
+	// recorded. It can't check its ranges against that commit, so it conflicts if it has any.
+	rangesUnchecked bool
 
 	pendingWrites map[string]*entry // cache stores any writes done by txn.
+	count         int64             // Number of entries Commit would write, including txn finish.
+	size          int64             // Estimated size of the entries Commit would write.
 
 	db        *DB
 	callbacks []func()
@@ -192,55 +390,115 @@ type Txn struct {
 // bits corresponding to the key-value pair.
 //
 // This would fail with ErrReadOnlyTxn if update flag was set to false when creating the
-// transaction.
+// transaction. It returns ErrTxnTooBig if the write doesn't fit into the transaction, in which
+// case the transaction can be committed and the write retried in a new one.
 func (txn *Txn) Set(key, val []byte, userMeta byte) error {
-	if !txn.update {
-		return ErrReadOnlyTxn
-	} else if txn.discarded {
-		return ErrDiscardedTxn
-	} else if len(key) == 0 {
-		return ErrEmptyKey
-	} else if len(key) > maxKeySize {
-		return exceedsMaxKeySizeError(key)
-	} else if int64(len(val)) > txn.db.opt.ValueLogFileSize {
-		return exceedsMaxValueSizeError(val, txn.db.opt.ValueLogFileSize)
-	}
-
-	fp := farm.Fingerprint64(key) // Avoid dealing with byte arrays.
-	txn.writes = append(txn.writes, fp)
-
 	e := &entry{
 		Key:      key,
 		Value:    val,
 		UserMeta: userMeta,
 	}
-	txn.pendingWrites[string(key)] = e
-	return nil
+	return txn.setEntry(e)
 }
 
-// Delete deletes a key. This is done by adding a delete marker for the key at commit timestamp.
-// Any reads happening before this timestamp would be unaffected. Any reads after this commit would
-// see the deletion.
-func (txn *Txn) Delete(key []byte) error {
+// SetWithTTL adds a key-value pair to the database, along with a time-to-live (TTL) setting.
+// A key stored with a TTL would automatically expire after the time has elapsed , and be
+// eligible for garbage collection.
+//
+// Expired keys are not returned by Get or by iteration. The expiry timestamp is available via
+// Item.ExpiresAt.
+func (txn *Txn) SetWithTTL(key, val []byte, userMeta byte, ttl time.Duration) error {
+	e := &entry{
+		Key:       key,
+		Value:     val,
+		UserMeta:  userMeta,
+		ExpiresAt: uint64(time.Now().Add(ttl).Unix()),
+	}
+	return txn.setEntry(e)
+}
+
+func (txn *Txn) setEntry(e *entry) error {
 	if !txn.update {
 		return ErrReadOnlyTxn
 	} else if txn.discarded {
 		return ErrDiscardedTxn
-	} else if len(key) == 0 {
+	} else if len(e.Key) == 0 {
 		return ErrEmptyKey
-	} else if len(key) > maxKeySize {
-		return exceedsMaxKeySizeError(key)
+	} else if len(e.Key) > maxKeySize {
+		return exceedsMaxKeySizeError(e.Key)
+	} else if int64(len(e.Value)) > txn.db.opt.ValueLogFileSize {
+		return exceedsMaxValueSizeError(e.Value, txn.db.opt.ValueLogFileSize)
+	}
+
+	if err := txn.checkSize(e); err != nil {
+		return err
+	}
+	if !txn.noConflicts {
+		fp := farm.Fingerprint64(e.Key) // Avoid dealing with byte arrays.
+		txn.writes = append(txn.writes, fp)
 	}
+	txn.pendingWrites[string(e.Key)] = e
+	return nil
+}
+
+// checkSize accounts for e in the running count and size of txn, returning ErrTxnTooBig if the
+// txn would no longer fit into a single write request. A write to a key already pending in txn
+// replaces the earlier one, so only the difference in size is accounted for.
+func (txn *Txn) checkSize(e *entry) error {
+	count, size := txn.count, txn.size
+	if old, ok := txn.pendingWrites[string(e.Key)]; ok {
+		size -= txnEntrySize(txn.db, old)
+	} else {
+		count++
+	}
+	size += txnEntrySize(txn.db, e)
+	if count >= txn.db.opt.maxBatchCount || size >= txn.db.opt.maxBatchSize {
+		return ErrTxnTooBig
+	}
+	txn.count, txn.size = count, size
+	return nil
+}
 
-	fp := farm.Fingerprint64(key) // Avoid dealing with byte arrays.
-	txn.writes = append(txn.writes, fp)
+// txnEntrySize returns the estimated size of e once Commit suffixes its key with the commit ts.
+func txnEntrySize(db *DB, e *entry) int64 {
+	return int64(db.opt.estimateSize(e)) + 8
+}
+
+// txnFinEntrySize is an upper bound on the estimated size of the entry Commit adds to mark the
+// end of a transaction.
+var txnFinEntrySize = int64(len(txnKey) + 8 + 20 + 2) // key, ts, commit ts as a string, metas.
 
+// Size returns the estimated size of the entries Commit would write for this transaction,
+// including the entry marking the end of the transaction.
+func (txn *Txn) Size() int64 {
+	return txn.size
+}
+
+// Count returns the number of entries Commit would write for this transaction, including the
+// entry marking the end of the transaction.
+func (txn *Txn) Count() int64 {
+	return txn.count
+}
+
+// MaxSize returns the limit on Size, beyond which Set and Delete return ErrTxnTooBig.
+func (txn *Txn) MaxSize() int64 {
+	return txn.db.opt.maxBatchSize
+}
+
+// MaxCount returns the limit on Count, beyond which Set and Delete return ErrTxnTooBig.
+func (txn *Txn) MaxCount() int64 {
+	return txn.db.opt.maxBatchCount
+}
+
+// Delete deletes a key. This is done by adding a delete marker for the key at commit timestamp.
+// Any reads happening before this timestamp would be unaffected. Any reads after this commit would
+// see the deletion. Like Set, it returns ErrTxnTooBig if the transaction can't take any more writes.
+func (txn *Txn) Delete(key []byte) error {
 	e := &entry{
 		Key:  key,
 		Meta: bitDelete,
 	}
-	txn.pendingWrites[string(key)] = e
-	return nil
+	return txn.setEntry(e)
 }
 
 // Get looks for key and returns corresponding Item.
@@ -255,10 +513,14 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	item = new(Item)
 	if txn.update {
 		if e, has := txn.pendingWrites[string(key)]; has && bytes.Equal(key, e.Key) {
+			if isDeletedOrExpired(e.Meta, e.ExpiresAt) {
+				return nil, ErrKeyNotFound
+			}
 			// Fulfill from cache.
 			item.meta = e.Meta
 			item.val = e.Value
 			item.userMeta = e.UserMeta
+			item.expiresAt = e.ExpiresAt
 			item.key = key
 			item.status = prefetched
 			item.version = txn.readTs
@@ -279,7 +541,7 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	if vs.Value == nil && vs.Meta == 0 {
 		return nil, ErrKeyNotFound
 	}
-	if (vs.Meta & bitDelete) != 0 {
+	if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
 		return nil, ErrKeyNotFound
 	}
 
@@ -287,12 +549,93 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	item.version = vs.Version
 	item.meta = vs.Meta
 	item.userMeta = vs.UserMeta
+	item.expiresAt = vs.ExpiresAt
 	item.db = txn.db
 	item.vptr = vs.Value
 	item.txn = txn
 	return item, nil
 }
 
+// pendingWritesIterator iterates over the writes buffered in an update transaction, so that
+// iteration inside the transaction can see them. Keys are returned at the txn's read timestamp,
+// which makes them take precedence over any committed version.
+type pendingWritesIterator struct {
+	entries  []*entry
+	nextIdx  int
+	readTs   uint64
+	reversed bool
+}
+
+func (pi *pendingWritesIterator) Next() {
+	pi.nextIdx++
+}
+
+func (pi *pendingWritesIterator) Rewind() {
+	pi.nextIdx = 0
+}
+
+func (pi *pendingWritesIterator) Seek(key []byte) {
+	key = y.ParseKey(key)
+	pi.nextIdx = sort.Search(len(pi.entries), func(idx int) bool {
+		cmp := bytes.Compare(pi.entries[idx].Key, key)
+		if !pi.reversed {
+			return cmp >= 0
+		}
+		return cmp <= 0
+	})
+}
+
+func (pi *pendingWritesIterator) Key() []byte {
+	y.AssertTrue(pi.Valid())
+	e := pi.entries[pi.nextIdx]
+	return y.KeyWithTs(e.Key, pi.readTs)
+}
+
+func (pi *pendingWritesIterator) Value() y.ValueStruct {
+	y.AssertTrue(pi.Valid())
+	e := pi.entries[pi.nextIdx]
+	return y.ValueStruct{
+		Value:     e.Value,
+		Meta:      e.Meta,
+		UserMeta:  e.UserMeta,
+		ExpiresAt: e.ExpiresAt,
+		Version:   pi.readTs,
+	}
+}
+
+func (pi *pendingWritesIterator) Valid() bool {
+	return pi.nextIdx < len(pi.entries)
+}
+
+func (pi *pendingWritesIterator) Close() error {
+	return nil
+}
+
+// newPendingWritesIterator returns an iterator over a sorted snapshot of txn.pendingWrites, or
+// nil if there is nothing to iterate over.
+func (txn *Txn) newPendingWritesIterator(reversed bool) *pendingWritesIterator {
+	if !txn.update || len(txn.pendingWrites) == 0 {
+		return nil
+	}
+	entries := make([]*entry, 0, len(txn.pendingWrites))
+	for _, e := range txn.pendingWrites {
+		entries = append(entries, e)
+	}
+	// Number of pending writes per transaction shouldn't be too big in general.
+	sort.Slice(entries, func(i, j int) bool {
+		cmp := bytes.Compare(entries[i].Key, entries[j].Key)
+		if !reversed {
+			return cmp < 0
+		}
+		return cmp > 0
+	})
+	return &pendingWritesIterator{
+		readTs:   txn.readTs,
+		entries:  entries,
+		reversed: reversed,
+	}
+}
+
 // Discard discards a created transaction. This method is very important and must be called. Commit
 // method calls this internally, however, calling this multiple times doesn't cause any issues. So,
 // this can safely be called via a defer right when transaction is created.
@@ -303,11 +646,13 @@ func (txn *Txn) Discard() {
 		return
 	}
 	txn.discarded = true
+	txn.db.orc.doneRead(txn.readTs)
 
 	for _, cb := range txn.callbacks {
 		cb()
 	}
 	if txn.update {
+		txn.db.orc.doneUpdate()
 		txn.db.orc.decrRef()
 	}
 }
@@ -338,7 +683,7 @@ func (txn *Txn) Commit(callback func(error)) error {
 		return ErrDiscardedTxn
 	}
 	defer txn.Discard()
-	if len(txn.writes) == 0 {
+	if len(txn.pendingWrites) == 0 {
 		return nil // Nothing to do.
 	}
 
@@ -409,10 +754,13 @@ func (db *DB) NewTransaction(update bool) *Txn {
 	txn := &Txn{
 		update: update,
 		db:     db,
-		readTs: db.orc.readTs(),
 	}
-	if update {
+	if !update {
+		txn.readTs = db.orc.startRead()
+	} else {
+		txn.readTs = db.orc.startUpdate()
 		txn.pendingWrites = make(map[string]*entry)
+		txn.count, txn.size = 1, txnFinEntrySize // Account for the txn finish entry.
 		txn.db.orc.addRef()
 	}
 	return txn
@@ -423,10 +771,30 @@ func (db *DB) NewTransaction(update bool) *Txn {
 // most users.
 func (db *DB) NewTransactionAt(readTs uint64, update bool) *Txn {
 	txn := db.NewTransaction(update)
+	db.orc.markRead(readTs)
+	db.orc.doneRead(txn.readTs)
 	txn.readTs = readTs
+	if update {
+		db.orc.Lock()
+		txn.rangesUnchecked = db.orc.untrackedTs > readTs
+		db.orc.Unlock()
+	}
 	return txn
 }
 
+// SetDiscardTs sets a timestamp at or below which only the latest NumVersionsToKeep versions of
+// each key are kept by compactions. In managed mode, Badger doesn't know the timestamps the user
+// is still reading at, so the user must set it. It's safe to keep it at zero, which keeps every
+// version.
+//
+// This API can only be used in managed mode.
+func (db *DB) SetDiscardTs(ts uint64) {
+	if !db.opt.ManagedTxns {
+		panic("SetDiscardTs can only be used in managed mode")
+	}
+	atomic.StoreUint64(&db.orc.discardTs, ts)
+}
+
 // View executes a function creating and managing a read-only transaction for the user. Error
 // returned by the function is relayed by the View method.
 func (db *DB) View(fn func(txn *Txn) error) error {
@@ -230,6 +230,134 @@ func TestTxnWriteSkew(t *testing.T) {
 	require.Equal(t, uint64(2), kv.orc.readTs())
 }
 
+// A txn which counts the keys with a prefix, and inserts one if there are too few, must conflict
+// with a concurrent insert into the same prefix, even though it never read the inserted key.
+func TestTxnPhantom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	txnSet(t, kv, []byte("group/a"), []byte("a"), 0)
+	txnSet(t, kv, []byte("other"), []byte("o"), 0)
+
+	count := func(txn *Txn, prefix []byte, reversed bool) int {
+		opt := DefaultIteratorOptions
+		opt.Reverse = reversed
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		var n int
+		if reversed {
+			prefix = append(prefix, 0xFF)
+		}
+		for it.Seek(prefix); it.ValidForPrefix(prefix[:6]); it.Next() {
+			n++
+		}
+		return n
+	}
+
+	for _, reversed := range []bool{false, true} {
+		txn1 := kv.NewTransaction(true)
+		require.Equal(t, 1, count(txn1, []byte("group/"), reversed))
+		require.NoError(t, txn1.Set([]byte("group/b"), []byte("b"), 0))
+
+		txn2 := kv.NewTransaction(true)
+		require.Equal(t, 1, count(txn2, []byte("group/"), reversed))
+		require.NoError(t, txn2.Set([]byte("group/c"), []byte("c"), 0))
+
+		require.NoError(t, txn1.Commit(nil))
+		require.Equal(t, ErrConflict, txn2.Commit(nil))
+
+		txnDelete(t, kv, []byte("group/b"))
+	}
+
+	// Writes outside of the scanned range don't conflict.
+	txn1 := kv.NewTransaction(true)
+	require.Equal(t, 1, count(txn1, []byte("group/"), false))
+	require.NoError(t, txn1.Set([]byte("group/b"), []byte("b"), 0))
+
+	txn2 := kv.NewTransaction(true)
+	require.NoError(t, txn2.Set([]byte("aaa"), []byte("c"), 0))
+	require.NoError(t, txn2.Set([]byte("zzz"), []byte("c"), 0))
+	require.NoError(t, txn2.Commit(nil))
+	require.NoError(t, txn1.Commit(nil))
+}
+
+func TestTxnCommittedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	committed := func() int {
+		kv.orc.Lock()
+		defer kv.orc.Unlock()
+		return len(kv.orc.committed)
+	}
+	scan := func(txn *Txn) {
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+		}
+	}
+
+	// The keys aren't recorded while no other update txn is pending.
+	for i := 0; i < 10; i++ {
+		txnSet(t, kv, []byte(fmt.Sprintf("key%d", i)), []byte("v"), 0)
+	}
+	require.Equal(t, 0, committed())
+
+	// A txn is checked against the keys of the commits since it started, even if it only starts
+	// iterating after them.
+	seek := func(txn *Txn) {
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek([]byte("key")); it.Valid(); it.Next() {
+		}
+		require.NoError(t, txn.Set([]byte("other"), []byte("v"), 0))
+	}
+	pending := kv.NewTransaction(true)
+	txnSet(t, kv, []byte("aaa"), []byte("v"), 0)
+	seek(pending)
+	require.NoError(t, pending.Commit(nil))
+	pending = kv.NewTransaction(true)
+	txnSet(t, kv, []byte("key5"), []byte("v"), 0)
+	seek(pending)
+	require.Equal(t, ErrConflict, pending.Commit(nil))
+
+	// So is a txn starting while a commit which wasn't recorded is still in flight.
+	inFlight := kv.NewTransaction(true)
+	require.NoError(t, inFlight.Set([]byte("key7"), []byte("v"), 0))
+	commitTs := kv.orc.newCommitTs(inFlight)
+	require.Equal(t, 0, committed())
+	pending = kv.NewTransaction(true)
+	require.True(t, pending.readTs < commitTs)
+	require.Equal(t, 1, committed())
+	kv.orc.doneCommit(commitTs)
+	inFlight.Discard()
+	seek(pending)
+	require.Equal(t, ErrConflict, pending.Commit(nil))
+
+	// Under overlapping txns, the keys are dropped once no pending txn reads below them.
+	prev := kv.NewTransaction(true)
+	scan(prev)
+	for i := 0; i < 100; i++ {
+		txn := kv.NewTransaction(true)
+		scan(txn)
+		txnSet(t, kv, []byte(fmt.Sprintf("key%d", i)), []byte("v"), 0)
+		prev.Discard()
+		prev = txn
+	}
+	require.True(t, committed() <= 2, "%d commits recorded", committed())
+	prev.Discard()
+	txnSet(t, kv, []byte("key"), []byte("v"), 0)
+	require.Equal(t, 0, committed())
+}
+
 // a2, a3, b4 (del), b3, c2, c1
 // Read at ts=4 -> a3, c2
 // Read at ts=3 -> a3, b3, c2
@@ -528,6 +656,114 @@ func TestIteratorAllVersionsButDeleted(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestTxnIteratorPendingWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	txnSet(t, kv, []byte("a"), []byte("a1"), 0)
+	txnSet(t, kv, []byte("c"), []byte("c1"), 0)
+	txnSet(t, kv, []byte("e"), []byte("e1"), 0)
+
+	iterate := func(txn *Txn, reversed bool) []string {
+		opt := DefaultIteratorOptions
+		opt.Reverse = reversed
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		var out []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			val, err := item.Value()
+			require.NoError(t, err)
+			out = append(out, fmt.Sprintf("%s=%s", item.Key(), val))
+		}
+		return out
+	}
+
+	txn := kv.NewTransaction(true)
+	defer txn.Discard()
+	require.NoError(t, txn.Set([]byte("b"), []byte("b2"), 0))
+	require.NoError(t, txn.Set([]byte("c"), []byte("c2"), 0))
+	require.NoError(t, txn.Delete([]byte("e")))
+
+	require.Equal(t, []string{"a=a1", "b=b2", "c=c2"}, iterate(txn, false))
+	require.Equal(t, []string{"c=c2", "b=b2", "a=a1"}, iterate(txn, true))
+
+	// Seek should also take pending writes into account.
+	opt := DefaultIteratorOptions
+	it := txn.NewIterator(opt)
+	it.Seek([]byte("b"))
+	require.True(t, it.Valid())
+	require.Equal(t, []byte("b"), it.Item().Key())
+	it.Close()
+
+	opt.Reverse = true
+	it = txn.NewIterator(opt)
+	it.Seek([]byte("d"))
+	require.True(t, it.Valid())
+	require.Equal(t, []byte("c"), it.Item().Key())
+	it.Close()
+
+	// A read-only txn doesn't see any of it.
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		require.Equal(t, []string{"a=a1", "c=c1", "e=e1"}, iterate(txn, false))
+		return nil
+	}))
+}
+
+func TestTxnTooBig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%09d", i))
+	}
+
+	txn := kv.NewTransaction(true)
+	defer txn.Discard()
+	require.Equal(t, int64(1), txn.Count())
+	require.Equal(t, txnFinEntrySize, txn.Size())
+
+	var i int
+	for ; ; i++ {
+		err := txn.Set(key(i), key(i), 0)
+		if err == ErrTxnTooBig {
+			break
+		}
+		require.NoError(t, err)
+		require.True(t, txn.Count() < txn.MaxCount())
+		require.True(t, txn.Size() < txn.MaxSize())
+	}
+	require.True(t, i > 0)
+	require.Equal(t, ErrTxnTooBig, txn.Delete(key(i)))
+
+	// Overwriting a pending write doesn't grow the txn, and it still commits fine.
+	count, size := txn.Count(), txn.Size()
+	require.NoError(t, txn.Set(key(0), key(1), 0))
+	require.Equal(t, count, txn.Count())
+	require.Equal(t, size, txn.Size())
+	require.NoError(t, txn.Commit(nil))
+
+	// The rejected write goes through in a new txn.
+	txnSet(t, kv, key(i), key(i), 0)
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		item, err := txn.Get(key(0))
+		require.NoError(t, err)
+		require.Equal(t, key(1), getItemValue(t, item))
+		item, err = txn.Get(key(i))
+		require.NoError(t, err)
+		require.Equal(t, key(i), getItemValue(t, item))
+		return nil
+	}))
+}
+
 func TestTxnManaged(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger")
 	require.NoError(t, err)
@@ -25,14 +25,13 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"math"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/dgraph-io/badger/y"
 	"github.com/pkg/errors"
@@ -42,14 +41,25 @@ import (
 // Values have their first byte being byteData or byteDelete. This helps us distinguish between
 // a key that has never been seen and a key that has been explicitly deleted.
 const (
-	bitDelete       byte = 1 << 0 // Set if the key has been deleted.
+	// Set if the key has been deleted. The table package counts these in its properties.
+	bitDelete       byte = 1 << 0
 	bitValuePointer byte = 1 << 1 // Set if the value is NOT stored directly next to key.
+	// Set in the value log header of the entries whose key and value are encrypted. The entries
+	// handed out by the value log never have it.
+	bitEncrypted byte = 1 << 2
+	// Set in the value log header of the entries which expire, and so have their expiry time in
+	// it. The entries handed out by the value log never have it either.
+	bitExpires byte = 1 << 3
 
 	// The MSB 2 bits are for transactions.
 	bitTxn    byte = 1 << 6 // Set if the entry is part of a txn.
 	bitFinTxn byte = 1 << 7 // Set if the entry is to indicate end of txn in value log.
 
 	mi int64 = 1 << 20
+
+	// The value log files are mapped at twice their size, so they're kept well below the address
+	// space.
+	maxValueLogFileSize = 1 << 40
 )
 
 type logFile struct {
@@ -63,7 +73,7 @@ type logFile struct {
 	fd   *os.File
 	fid  uint32
 	fmap []byte
-	size uint32
+	size uint64
 }
 
 // openReadOnly assumes that we have a write lock on logFile.
@@ -78,7 +88,7 @@ func (lf *logFile) openReadOnly() error {
 	if err != nil {
 		return errors.Wrapf(err, "Unable to check stat for %q", lf.path)
 	}
-	lf.size = uint32(fi.Size())
+	lf.size = uint64(fi.Size())
 
 	if err = lf.mmap(fi.Size()); err != nil {
 		_ = lf.fd.Close()
@@ -102,8 +112,8 @@ var errTooFewBytes = errors.New("Too few bytes read")
 func (lf *logFile) read(p valuePointer) (buf []byte, err error) {
 	var nbr int64
 	offset := p.Offset
-	size := uint32(len(lf.fmap))
-	valsz := p.Len
+	size := uint64(len(lf.fmap))
+	valsz := uint64(p.Len)
 	if offset >= size || offset+valsz > size {
 		err = y.ErrEOF
 	} else {
@@ -115,7 +125,7 @@ func (lf *logFile) read(p valuePointer) (buf []byte, err error) {
 	return buf, err
 }
 
-func (lf *logFile) doneWriting(offset uint32) error {
+func (lf *logFile) doneWriting(offset uint64) error {
 	// Sync before acquiring lock.  (We call this from write() and thus know we have shared access
 	// to the fd.)
 	if err := lf.fd.Sync(); err != nil {
@@ -155,43 +165,60 @@ var errStop = errors.New("Stop iteration")
 type logEntry func(e entry, vp valuePointer) error
 
 // iterate iterates over log file. It doesn't not allocate new memory for every kv pair.
-// Therefore, the kv pair is only valid for the duration of fn call.
-func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn logEntry) error {
+// Therefore, the kv pair is only valid for the duration of fn call. It stops at the first entry
+// which is cut short or fails its checksum.
+func (vlog *valueLog) iterate(lf *logFile, offset uint64, fn logEntry) error {
 	_, err := lf.fd.Seek(int64(offset), io.SeekStart)
 	if err != nil {
 		return y.Wrap(err)
 	}
 
 	reader := bufio.NewReader(lf.fd)
-	var hbuf [headerBufSize]byte
+	var hbuf [maxHeaderSize]byte
 	var h header
 	k := make([]byte, 1<<10)
 	v := make([]byte, 1<<20)
 
-	truncate := false
 	recordOffset := offset
 	for {
 		hash := crc32.New(y.CastagnoliCrcTable)
 		tee := io.TeeReader(reader, hash)
 
 		// TODO: Move this entry decode into structs.go
-		if _, err = io.ReadFull(tee, hbuf[:]); err != nil {
-			if err == io.EOF {
-				break
-			} else if err == io.ErrUnexpectedEOF {
-				truncate = true
+		hlen := headerBufSize
+		if _, err = io.ReadFull(tee, hbuf[:hlen]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				break
 			}
 			return err
 		}
+		// The meta byte tells if the expiry time follows.
+		if hbuf[8]&bitExpires != 0 {
+			hlen = maxHeaderSize
+			if _, err = io.ReadFull(tee, hbuf[headerBufSize:hlen]); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				return err
+			}
+		}
 
 		var e entry
 		e.offset = recordOffset
-		h.Decode(hbuf[:])
+		h.Decode(hbuf[:hlen])
 		if h.klen > maxKeySize {
-			truncate = true
 			break
 		}
+		var encHeader [encryptionHeaderSize]byte
+		encrypted := h.meta&bitEncrypted != 0
+		if encrypted {
+			if _, err = io.ReadFull(tee, encHeader[:]); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				return err
+			}
+		}
 		vl := int(h.vlen)
 		if cap(v) < vl {
 			v = make([]byte, 2*vl)
@@ -206,16 +233,15 @@ func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn logEntry) error {
 
 		if _, err = io.ReadFull(tee, e.Key); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				truncate = true
 				break
 			}
 			return err
 		}
-		e.Meta = h.meta
+		e.Meta = h.meta &^ bitEncrypted
 		e.UserMeta = h.userMeta
+		e.ExpiresAt = h.expiresAt
 		if _, err = io.ReadFull(tee, e.Value); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				truncate = true
 				break
 			}
 			return err
@@ -224,21 +250,30 @@ func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn logEntry) error {
 		var crcBuf [4]byte
 		if _, err = io.ReadFull(reader, crcBuf[:]); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				truncate = true
 				break
 			}
 			return err
 		}
 		crc := binary.BigEndian.Uint32(crcBuf[:])
 		if crc != hash.Sum32() {
-			truncate = true
 			break
 		}
 
 		var vp valuePointer
 
-		vp.Len = headerBufSize + h.klen + h.vlen + uint32(len(crcBuf))
-		recordOffset += vp.Len
+		vp.Len = uint32(hlen) + h.klen + h.vlen + uint32(len(crcBuf))
+		if encrypted {
+			dk, err := vlog.kv.registry.DataKey(binary.BigEndian.Uint64(encHeader[:8]))
+			if err != nil {
+				return err
+			}
+			// The key and value are encrypted as one.
+			stream := dk.NewStream(encHeader[8:])
+			stream.XORKeyStream(e.Key, e.Key)
+			stream.XORKeyStream(e.Value, e.Value)
+			vp.Len += encryptionHeaderSize
+		}
+		recordOffset += uint64(vp.Len)
 
 		vp.Offset = e.offset
 		vp.Fid = lf.fid
@@ -251,13 +286,6 @@ func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn logEntry) error {
 		}
 	}
 
-	if truncate && len(lf.fmap) == 0 {
-		// Only truncate if the file isn't mmaped. Otherwise, Windows would puke.
-		if err := lf.fd.Truncate(int64(recordOffset)); err != nil {
-			return err
-		}
-	}
-
 	return nil
 }
 
@@ -273,6 +301,17 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 	var size int64
 
 	y.AssertTrue(vlog.kv != nil)
+	// batchSet writes out entries which were rewritten. The writes hit the disk as hard as
+	// compactions do, so they're charged to the same limiter, ahead of being written.
+	encrypted := len(vlog.opt.EncryptionKey) > 0
+	batchSet := func(entries []*entry) error {
+		var n int
+		for _, e := range entries {
+			n += e.encodedSize(encrypted)
+		}
+		vlog.kv.compactionLimiter.Wait(n)
+		return vlog.kv.batchSet(entries)
+	}
 	var count int
 	fe := func(e entry) error {
 		count++
@@ -306,6 +345,7 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 			ne := new(entry)
 			ne.Meta = 0 // Remove all bits.
 			ne.UserMeta = e.UserMeta
+			ne.ExpiresAt = e.ExpiresAt
 			ne.Key = make([]byte, len(e.Key))
 			copy(ne.Key, e.Key)
 			ne.Value = make([]byte, len(e.Value))
@@ -314,7 +354,7 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 			size += int64(vlog.opt.estimateSize(ne))
 			if size >= 64*mi {
 				elog.Printf("request has %d entries, size %d", len(wb), size)
-				if err := vlog.kv.batchSet(wb); err != nil {
+				if err := batchSet(wb); err != nil {
 					return err
 				}
 				size = 0
@@ -346,7 +386,7 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 		if end > len(wb) {
 			end = len(wb)
 		}
-		if err := vlog.kv.batchSet(wb[i:end]); err != nil {
+		if err := batchSet(wb[i:end]); err != nil {
 			if err == ErrTxnTooBig {
 				// Decrease the batch size to half.
 				batchSize = batchSize / 2
@@ -382,7 +422,62 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 		vlog.deleteLogFile(f)
 	}
 
-	return nil
+	// The file is gone, or soon will be, along with its garbage.
+	return vlog.discardStats.drop(f.fid)
+}
+
+// dropAll switches writes over to a new value log file, and deletes all the older ones. The files
+// still being read by iterators are only deleted once the iterators are done. It returns the
+// number of files deleted. Writes must be blocked.
+func (vlog *valueLog) dropAll() (int, error) {
+	vlog.filesLock.RLock()
+	curlf := vlog.filesMap[vlog.maxFid]
+	vlog.filesLock.RUnlock()
+	if atomic.LoadUint32(&vlog.maxFid) == math.MaxUint32 {
+		return 0, ErrValueLogFull
+	}
+	if err := curlf.doneWriting(vlog.writableOffset()); err != nil {
+		return 0, err
+	}
+
+	newid := atomic.AddUint32(&vlog.maxFid, 1)
+	newlf, err := vlog.createVlogFile(newid)
+	if err != nil {
+		return 0, err
+	}
+	if err = newlf.mmap(2 * vlog.opt.ValueLogFileSize); err != nil {
+		return 0, err
+	}
+
+	var toDelete []*logFile
+	var dropped []uint32
+	vlog.filesLock.Lock()
+	pending := make(map[uint32]struct{})
+	for _, fid := range vlog.filesToBeDeleted {
+		pending[fid] = struct{}{}
+	}
+	var count int
+	for fid, lf := range vlog.filesMap {
+		if _, ok := pending[fid]; ok || fid == newid {
+			continue
+		}
+		count++
+		dropped = append(dropped, fid)
+		if vlog.numActiveIterators == 0 {
+			delete(vlog.filesMap, fid)
+			toDelete = append(toDelete, lf)
+		} else {
+			vlog.filesToBeDeleted = append(vlog.filesToBeDeleted, fid)
+		}
+	}
+	vlog.filesLock.Unlock()
+
+	for _, lf := range toDelete {
+		if err := vlog.deleteLogFile(lf); err != nil {
+			return count, err
+		}
+	}
+	return count, vlog.discardStats.drop(dropped...)
 }
 
 func (vlog *valueLog) incrIteratorCount() {
@@ -441,10 +536,11 @@ type valueLog struct {
 
 	kv                *DB
 	maxFid            uint32
-	writableLogOffset uint32
+	writableLogOffset uint64
 	opt               Options
 
-	garbageCh chan struct{}
+	garbageCh    chan struct{}
+	discardStats *discardStats
 }
 
 func vlogFilePath(dirPath string, fid uint32) string {
@@ -528,6 +624,7 @@ func (vlog *valueLog) createVlogFile(fid uint32) (*logFile, error) {
 	vlog.filesLock.Lock()
 	vlog.filesMap[fid] = lf
 	vlog.filesLock.Unlock()
+	vlog.discardStats.addLive(fid)
 
 	return lf, nil
 }
@@ -540,6 +637,13 @@ func (vlog *valueLog) Open(kv *DB, opt Options) error {
 	if err := vlog.openOrCreateFiles(); err != nil {
 		return errors.Wrapf(err, "Unable to open value log")
 	}
+	fids := make([]uint32, 0, len(vlog.filesMap))
+	for fid := range vlog.filesMap {
+		fids = append(fids, fid)
+	}
+	if err := vlog.discardStats.setLive(fids); err != nil {
+		return err
+	}
 
 	vlog.elog = trace.NewEventLog("Badger", "Valuelog")
 	vlog.garbageCh = make(chan struct{}, 1) // Only allow one GC at a time.
@@ -597,7 +701,7 @@ func (vlog *valueLog) sortedFids() []uint32 {
 // Replay replays the value log. The kv provided is only valid for the lifetime of function call.
 func (vlog *valueLog) Replay(ptr valuePointer, fn logEntry) error {
 	fid := ptr.Fid
-	offset := ptr.Offset + ptr.Len
+	offset := ptr.Offset + uint64(ptr.Len)
 	vlog.elog.Printf("Seeking at value pointer: %+v\n", ptr)
 
 	fids := vlog.sortedFids()
@@ -611,20 +715,67 @@ func (vlog *valueLog) Replay(ptr valuePointer, fn logEntry) error {
 			of = 0
 		}
 		f := vlog.filesMap[id]
-		err := vlog.iterate(f, of, fn)
+		// The end of the last complete transaction, or of the last entry from a rewrite, which
+		// isn't part of one.
+		endOffset := of
+		var incomplete int // Transactions begun after endOffset.
+		var txnTs uint64
+		err := vlog.iterate(f, of, func(e entry, vp valuePointer) error {
+			if e.Meta&bitFinTxn != 0 || e.Meta&bitTxn == 0 {
+				endOffset, incomplete, txnTs = vp.Offset+uint64(vp.Len), 0, 0
+			} else if ts := y.ParseTs(e.Key); ts != txnTs {
+				incomplete, txnTs = incomplete+1, ts
+			}
+			return fn(e, vp)
+		})
 		if err != nil {
 			return errors.Wrapf(err, "Unable to replay value log: %q", f.path)
 		}
+		if id == vlog.maxFid {
+			if err := vlog.truncateTail(f, endOffset, incomplete); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Seek to the end to start writing.
 	var err error
 	last := vlog.filesMap[vlog.maxFid]
 	lastOffset, err := last.fd.Seek(0, io.SeekEnd)
-	atomic.AddUint32(&vlog.writableLogOffset, uint32(lastOffset))
+	atomic.AddUint64(&vlog.writableLogOffset, uint64(lastOffset))
 	return errors.Wrapf(err, "Unable to seek to end of value log: %q", last.path)
 }
 
+// truncateTail drops the end of the last value log file from endOffset on, if there's anything
+// there: the entries of incomplete transactions, and whatever was left of an entry cut short or
+// corrupted by a crash. The file mustn't be mmaped yet, or Windows would puke.
+func (vlog *valueLog) truncateTail(lf *logFile, endOffset uint64, incomplete int) error {
+	fi, err := lf.fd.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Unable to check stat for %q", lf.path)
+	}
+	size := uint64(fi.Size())
+	if endOffset >= size {
+		return nil
+	}
+	if !vlog.opt.Truncate {
+		return errors.Wrapf(ErrTruncateNeeded, "%d bytes at the end of %q, from offset %d",
+			size-endOffset, lf.path, endOffset)
+	}
+	if incomplete == 0 {
+		// No entry made it whole, but some transaction was being written.
+		incomplete = 1
+	}
+	msg := fmt.Sprintf("Truncating value log %q from %d to %d bytes, dropping %d incomplete "+
+		"transactions.", lf.path, size, endOffset, incomplete)
+	log.Printf("WARNING: %s", msg)
+	vlog.elog.Printf("%s", msg)
+	if err := lf.fd.Truncate(int64(endOffset)); err != nil {
+		return errors.Wrapf(err, "Unable to truncate value log: %q", lf.path)
+	}
+	return nil
+}
+
 type request struct {
 	// Input values
 	Entries []*entry
@@ -660,8 +811,8 @@ func (vlog *valueLog) sync() error {
 	return err
 }
 
-func (vlog *valueLog) writableOffset() uint32 {
-	return atomic.LoadUint32(&vlog.writableLogOffset)
+func (vlog *valueLog) writableOffset() uint64 {
+	return atomic.LoadUint64(&vlog.writableLogOffset)
 }
 
 // write is thread-unsafe by design and should not be called concurrently.
@@ -669,6 +820,13 @@ func (vlog *valueLog) write(reqs []*request) error {
 	vlog.filesLock.RLock()
 	curlf := vlog.filesMap[vlog.maxFid]
 	vlog.filesLock.RUnlock()
+	if curlf.fid == math.MaxUint32 && vlog.writableOffset() > uint64(vlog.opt.ValueLogFileSize) {
+		return ErrValueLogFull
+	}
+	dk, err := vlog.kv.registry.latestDataKey()
+	if err != nil {
+		return err
+	}
 
 	toDisk := func() error {
 		if vlog.buf.Len() == 0 {
@@ -682,17 +840,21 @@ func (vlog *valueLog) write(reqs []*request) error {
 		y.NumWrites.Add(1)
 		y.NumBytesWritten.Add(int64(n))
 		vlog.elog.Printf("Done")
-		atomic.AddUint32(&vlog.writableLogOffset, uint32(n))
+		atomic.AddUint64(&vlog.writableLogOffset, uint64(n))
 		vlog.buf.Reset()
 
-		if vlog.writableOffset() > uint32(vlog.opt.ValueLogFileSize) {
+		if vlog.writableOffset() > uint64(vlog.opt.ValueLogFileSize) {
+			if atomic.LoadUint32(&vlog.maxFid) == math.MaxUint32 {
+				// The last file id is taken. What's written stays readable, and the writes after
+				// it are rejected.
+				return nil
+			}
 			var err error
-			if err = curlf.doneWriting(vlog.writableLogOffset); err != nil {
+			if err = curlf.doneWriting(vlog.writableOffset()); err != nil {
 				return err
 			}
 
 			newid := atomic.AddUint32(&vlog.maxFid, 1)
-			y.AssertTruef(newid < 1<<16, "newid will overflow uint16: %v", newid)
 			newlf, err := vlog.createVlogFile(newid)
 			if err != nil {
 				return err
@@ -716,15 +878,15 @@ func (vlog *valueLog) write(reqs []*request) error {
 
 			p.Fid = curlf.fid
 			// Use the offset including buffer length so far.
-			p.Offset = vlog.writableOffset() + uint32(vlog.buf.Len())
-			plen, err := encodeEntry(e, &vlog.buf) // Now encode the entry into buffer.
+			p.Offset = vlog.writableOffset() + uint64(vlog.buf.Len())
+			plen, err := encodeEntry(e, &vlog.buf, dk) // Now encode the entry into buffer.
 			if err != nil {
 				return err
 			}
 			p.Len = uint32(plen)
 			b.Ptrs = append(b.Ptrs, p)
 
-			if p.Offset > uint32(vlog.opt.ValueLogFileSize) {
+			if p.Offset > uint64(vlog.opt.ValueLogFileSize) {
 				if err := toDisk(); err != nil {
 					return err
 				}
@@ -765,15 +927,15 @@ func (vlog *valueLog) Read(vp valuePointer) ([]byte, func(), error) {
 	if err != nil {
 		return nil, cb, err
 	}
-	var h header
-	h.Decode(buf)
-	if (h.meta & bitDelete) != 0 {
+	e, err := vlog.decodeEntry(buf)
+	if err != nil {
+		return nil, cb, err
+	}
+	if (e.Meta & bitDelete) != 0 {
 		// Tombstone key
 		return nil, cb, nil
 	}
-	n := uint32(headerBufSize)
-	n += h.klen
-	return buf[n : n+h.vlen], cb, nil
+	return e.Value, cb, nil
 }
 
 func (vlog *valueLog) readValueBytes(vp valuePointer) ([]byte, func(), error) {
@@ -786,33 +948,62 @@ func (vlog *valueLog) readValueBytes(vp valuePointer) ([]byte, func(), error) {
 	return buf, lf.lock.RUnlock, err
 }
 
-// Test helper
-func valueBytesToEntry(buf []byte) (e entry) {
+// decodeEntry decodes the entry in buf, as read from the value log. The key and value point into
+// buf, unless they're encrypted, in which case they're decrypted into a new buffer.
+func (vlog *valueLog) decodeEntry(buf []byte) (e entry, err error) {
 	var h header
-	h.Decode(buf)
-	n := uint32(headerBufSize)
+	n := uint32(h.Decode(buf))
 
+	e.Meta = h.meta &^ bitEncrypted
+	e.UserMeta = h.userMeta
+	e.ExpiresAt = h.expiresAt
+	if h.meta&bitEncrypted != 0 {
+		dk, err := vlog.kv.registry.DataKey(binary.BigEndian.Uint64(buf[n : n+8]))
+		if err != nil {
+			return e, err
+		}
+		iv := buf[n+8 : n+encryptionHeaderSize]
+		n += encryptionHeaderSize
+		data := make([]byte, h.klen+h.vlen)
+		dk.XOR(data, buf[n:n+h.klen+h.vlen], iv)
+		buf, n = data, 0
+	}
 	e.Key = buf[n : n+h.klen]
 	n += h.klen
-	e.Meta = h.meta
-	e.UserMeta = h.userMeta
 	e.Value = buf[n : n+h.vlen]
-	return
+	return e, nil
 }
 
-func (vlog *valueLog) pickLog() *logFile {
+// pickLog returns the value log file with the highest ratio of discarded bytes, as counted by the
+// discard stats, or nil if that ratio is below discardRatio. The file being written to is never
+// picked.
+func (vlog *valueLog) pickLog(discardRatio float64) *logFile {
 	vlog.filesLock.RLock()
 	defer vlog.filesLock.RUnlock()
-	fids := vlog.sortedFids()
-	if len(fids) <= 1 {
-		return nil
+	maxFid := atomic.LoadUint32(&vlog.maxFid)
+	var picked *logFile
+	var pickedRatio float64
+	for _, fid := range vlog.sortedFids() {
+		if fid >= maxFid {
+			continue
+		}
+		lf := vlog.filesMap[fid]
+		lf.lock.RLock()
+		size := lf.size
+		lf.lock.RUnlock()
+		if size == 0 {
+			continue
+		}
+		ratio := float64(vlog.discardStats.get(fid)) / float64(size)
+		if ratio > pickedRatio {
+			picked, pickedRatio = lf, ratio
+		}
 	}
-	// This file shouldn't be being written to.
-	idx := rand.Intn(len(fids))
-	if idx > 0 {
-		idx = rand.Intn(idx) // Another level of rand to favor smaller fids.
+	if picked == nil || pickedRatio < discardRatio {
+		return nil
 	}
-	return vlog.filesMap[fids[idx]]
+	vlog.elog.Printf("Picked fid: %d with discard ratio: %.2f", picked.fid, pickedRatio)
+	return picked
 }
 
 func discardEntry(e entry, vs y.ValueStruct) bool {
@@ -820,8 +1011,8 @@ func discardEntry(e entry, vs y.ValueStruct) bool {
 		// Version not found. Discard.
 		return true
 	}
-	if (vs.Meta & bitDelete) > 0 {
-		// Key deleted. Discard.
+	if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+		// Key deleted or expired. Discard.
 		return true
 	}
 	if (vs.Meta & bitValuePointer) == 0 {
@@ -836,104 +1027,13 @@ func discardEntry(e entry, vs y.ValueStruct) bool {
 }
 
 func (vlog *valueLog) doRunGC(gcThreshold float64) error {
-	lf := vlog.pickLog()
+	lf := vlog.pickLog(gcThreshold)
 	if lf == nil {
 		return ErrNoRewrite
 	}
 
-	type reason struct {
-		total   float64
-		keep    float64
-		discard float64
-	}
-
-	var r reason
-	var window = 100.0
-	count := 0
-
-	// Pick a random start point for the log.
-	skipFirstM := float64(rand.Intn(int(vlog.opt.ValueLogFileSize/mi))) - window
-	var skipped float64
-
-	start := time.Now()
-	y.AssertTrue(vlog.kv != nil)
-	err := vlog.iterate(lf, 0, func(e entry, vp valuePointer) error {
-		esz := float64(vp.Len) / (1 << 20) // in MBs. +4 for the CAS stuff.
-		skipped += esz
-		if skipped < skipFirstM {
-			return nil
-		}
-
-		count++
-		if count%100 == 0 {
-			time.Sleep(time.Millisecond)
-		}
-		r.total += esz
-		if r.total > window {
-			return errStop
-		}
-		if time.Since(start) > 10*time.Second {
-			return errStop
-		}
-
-		vs, err := vlog.kv.get(e.Key)
-		if err != nil {
-			return err
-		}
-		if discardEntry(e, vs) {
-			r.discard += esz
-			return nil
-		}
-
-		// Value is still present in value log.
-		y.AssertTrue(len(vs.Value) > 0)
-		vp.Decode(vs.Value)
-
-		if vp.Fid > lf.fid {
-			// Value is present in a later log. Discard.
-			r.discard += esz
-			return nil
-		}
-		if vp.Offset > e.offset {
-			// Value is present in a later offset, but in the same log.
-			r.discard += esz
-			return nil
-		}
-		if vp.Fid == lf.fid && vp.Offset == e.offset {
-			// This is still the active entry. This would need to be rewritten.
-			r.keep += esz
-
-		} else {
-			vlog.elog.Printf("Reason=%+v\n", r)
-
-			buf, cb, err := vlog.readValueBytes(vp)
-			if err != nil {
-				return errStop
-			}
-			ne := valueBytesToEntry(buf)
-			ne.offset = vp.Offset
-			ne.print("Latest Entry Header in LSM")
-			e.print("Latest Entry in Log")
-			runCallback(cb)
-			return errors.Errorf("This shouldn't happen. Latest Pointer:%+v. Meta:%v.",
-				vp, vs.Meta)
-		}
-		return nil
-	})
-
-	if err != nil {
-		vlog.elog.Errorf("Error while iterating for RunGC: %v", err)
-		return err
-	}
-	vlog.elog.Printf("Fid: %d Data status=%+v\n", lf.fid, r)
-
-	if r.total < 10.0 || r.discard < gcThreshold*r.total {
-		vlog.elog.Printf("Skipping GC on fid: %d\n\n", lf.fid)
-		return ErrNoRewrite
-	}
-
 	vlog.elog.Printf("REWRITING VLOG %d\n", lf.fid)
-	if err = vlog.rewrite(lf); err != nil {
+	if err := vlog.rewrite(lf); err != nil {
 		return err
 	}
 	vlog.elog.Printf("Done rewriting.")
@@ -17,13 +17,17 @@
 package badger
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"testing"
 
 	"github.com/dgraph-io/badger/y"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -66,7 +70,11 @@ func TestValueBasic(t *testing.T) {
 	defer runCallback(cb1)
 	defer runCallback(cb2)
 
-	readEntries := []entry{valueBytesToEntry(buf1), valueBytesToEntry(buf2)}
+	read1, err := log.decodeEntry(buf1)
+	require.NoError(t, err)
+	read2, err := log.decodeEntry(buf2)
+	require.NoError(t, err)
+	readEntries := []entry{read1, read2}
 	require.EqualValues(t, []entry{
 		{
 			Key:   []byte("samplekey"),
@@ -383,7 +391,12 @@ func TestChecksums(t *testing.T) {
 	buf[len(buf)-1]++ // Corrupt last byte
 	require.NoError(t, ioutil.WriteFile(vlogFilePath(dir, 0), buf, 0777))
 
-	// K1 should exist, but K2 shouldn't.
+	// Badger won't start up without dropping the corrupt transaction.
+	_, err = Open(opts)
+	require.Equal(t, ErrTruncateNeeded, errors.Cause(err))
+	opts.Truncate = true
+
+	// K0 should exist, but K1 and K2 shouldn't.
 	kv, err = Open(opts)
 	require.NoError(t, err)
 
@@ -466,10 +479,18 @@ func TestPartialAppendToValueLog(t *testing.T) {
 	buf = buf[:len(buf)-6]
 	require.NoError(t, ioutil.WriteFile(vlogFilePath(dir, 0), buf, 0777))
 
-	// Badger should now start up
+	// Badger should now start up, but only when allowed to drop the partial append.
+	_, err = Open(opts)
+	require.Equal(t, ErrTruncateNeeded, errors.Cause(err))
+	opts.Truncate = true
 	kv, err = Open(opts)
 	require.NoError(t, err)
 
+	// The vlog ends with the transaction of k0, the last one to complete.
+	fi, err := os.Stat(vlogFilePath(dir, 0))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(createVlog(t, []*entry{{Key: k0, Value: v0}}))), fi.Size())
+
 	require.NoError(t, kv.View(func(txn *Txn) error {
 		item, err := txn.Get(k0)
 		require.NoError(t, err)
@@ -491,6 +512,86 @@ func TestPartialAppendToValueLog(t *testing.T) {
 	require.NoError(t, kv.Close())
 }
 
+func TestDiscardStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 20
+	kv, err := Open(opt)
+	require.NoError(t, err)
+
+	sz := 32 << 10
+	for i := 0; i < 100; i++ {
+		txnSet(t, kv, []byte(fmt.Sprintf("key%d", i)), make([]byte, sz), 0)
+	}
+	for i := 0; i < 45; i++ {
+		txnDelete(t, kv, []byte(fmt.Sprintf("key%d", i)))
+	}
+
+	// Nothing is known to be garbage until a compaction drops the deleted keys.
+	require.Equal(t, ErrNoRewrite, kv.RunValueLogGC(0.5))
+	flushAndCompact(t, kv)
+	discarded := kv.vlog.discardStats.get(0)
+	require.True(t, discarded > int64(opt.ValueLogFileSize)/2, "Discarded: %d", discarded)
+	require.NoError(t, kv.Close())
+
+	// The stats survive a restart.
+	kv, err = Open(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	require.Equal(t, discarded, kv.vlog.discardStats.get(0))
+
+	// The first file is all garbage, so it goes first.
+	require.NoError(t, kv.RunValueLogGC(0.5))
+	kv.vlog.filesLock.RLock()
+	_, ok := kv.vlog.filesMap[0]
+	kv.vlog.filesLock.RUnlock()
+	require.False(t, ok)
+	require.Equal(t, int64(0), kv.vlog.discardStats.get(0))
+	require.Equal(t, 55, countKeys(t, kv, "key"))
+
+	// Compactions still dropping pointers into the deleted file don't count them anymore.
+	require.NoError(t, kv.vlog.discardStats.add(map[uint32]int64{0: 100}))
+	require.Equal(t, int64(0), kv.vlog.discardStats.get(0))
+}
+
+// The pointers into the value log of a DB written before their offsets took 64 bits are shorter,
+// and are read, moved by the value log GC and compacted alongside the new ones.
+func TestValueGCBaselineDir(t *testing.T) {
+	dir := copyBaselineDir(t)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 20
+	kv, err := Open(opt)
+	require.NoError(t, err)
+	checkBaselineDir(t, kv)
+
+	// Fill up the first value log file, behind the entries already in it, and turn most of it into
+	// garbage.
+	sz := 32 << 10
+	for i := 0; i < 40; i++ {
+		txnSet(t, kv, []byte(fmt.Sprintf("big%d", i)), make([]byte, sz), 0)
+	}
+	for i := 0; i < 40; i++ {
+		txnDelete(t, kv, []byte(fmt.Sprintf("big%d", i)))
+	}
+	flushAndCompact(t, kv)
+	require.NoError(t, kv.RunValueLogGC(0.5))
+	kv.vlog.filesLock.RLock()
+	_, ok := kv.vlog.filesMap[0]
+	kv.vlog.filesLock.RUnlock()
+	require.False(t, ok)
+	checkBaselineDir(t, kv)
+	require.NoError(t, kv.Close())
+
+	kv, err = Open(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	checkBaselineDir(t, kv)
+	require.Equal(t, 0, countKeys(t, kv, "big"))
+}
+
 func TestValueLogTrigger(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger")
 	require.NoError(t, err)
@@ -518,26 +619,93 @@ func TestValueLogTrigger(t *testing.T) {
 	for i := 0; i < 45; i++ {
 		txnDelete(t, kv, []byte(fmt.Sprintf("key%d", i)))
 	}
+	// The compaction counts the deleted values as garbage.
+	flushAndCompact(t, kv)
 
-	// Now attempt to run 5 value log GCs simultaneously.
-	errCh := make(chan error, 5)
+	// While a value log GC is running, any other one is rejected.
+	kv.vlog.garbageCh <- struct{}{}
 	for i := 0; i < 5; i++ {
-		go func() { errCh <- kv.RunValueLogGC(0.5) }()
+		require.Equal(t, ErrRejected, kv.RunValueLogGC(0.5))
 	}
-	var numRejected int
-	for i := 0; i < 5; i++ {
-		err := <-errCh
-		if err == ErrRejected {
-			numRejected++
-		}
-	}
-	require.True(t, numRejected > 0, "Should have found at least one value log GC request rejected.")
+	<-kv.vlog.garbageCh
+	require.NoError(t, kv.RunValueLogGC(0.5))
 	require.NoError(t, kv.Close())
 
 	err = kv.RunValueLogGC(0.5)
 	require.Equal(t, ErrRejected, err, "Error should be returned after closing DB.")
 }
 
+func TestValuePointerEncoding(t *testing.T) {
+	var buf [maxVptrSize]byte
+	for _, p := range []valuePointer{
+		{Fid: 1, Len: 2, Offset: 3},
+		{Fid: math.MaxUint32, Len: 100, Offset: math.MaxUint32},
+		{Fid: 1 << 16, Len: 100, Offset: math.MaxUint32 + 1},
+	} {
+		b := p.Encode(buf[:])
+		if p.Offset <= math.MaxUint32 {
+			// The pointers written before offsets went 64 bit decode as they always did.
+			require.Equal(t, vptrSize, len(b))
+			require.Equal(t, p.Offset, uint64(binary.BigEndian.Uint32(b[8:12])))
+		} else {
+			require.Equal(t, maxVptrSize, len(b))
+		}
+		var d valuePointer
+		d.Decode(b)
+		require.Equal(t, p, d)
+	}
+}
+
+func TestEntryEncodedSize(t *testing.T) {
+	dk, err := y.NewDataKey(1, []byte("0123456789abcdef"))
+	require.NoError(t, err)
+	e := &entry{Key: []byte("key"), Value: []byte("value"), UserMeta: 1, ExpiresAt: 1000}
+	for _, k := range []*y.DataKey{nil, dk} {
+		var buf bytes.Buffer
+		n, err := encodeEntry(e, &buf, k)
+		require.NoError(t, err)
+		require.Equal(t, buf.Len(), n)
+		require.Equal(t, n, e.encodedSize(k != nil))
+	}
+}
+
+func TestValueLogFileIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 20
+
+	// Start right below the last file id.
+	fp, err := os.Create(vlogFilePath(dir, math.MaxUint32-1))
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+	kv, err := Open(opt)
+	require.NoError(t, err)
+
+	sz := 64 << 10
+	var n int
+	for ; n < 100; n++ {
+		err = kv.Update(func(txn *Txn) error {
+			return txn.Set([]byte(fmt.Sprintf("key%d", n)), make([]byte, sz), 0)
+		})
+		if err != nil {
+			break
+		}
+	}
+	require.Equal(t, ErrValueLogFull, errors.Cause(err))
+	require.True(t, n >= 2*int(opt.ValueLogFileSize)/sz, "Written: %d", n)
+	_, err = os.Stat(vlogFilePath(dir, math.MaxUint32))
+	require.NoError(t, err)
+	require.NoError(t, kv.Close())
+
+	// What was written before the limit is all there.
+	kv, err = Open(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	require.Equal(t, n, countKeys(t, kv, "key"))
+}
+
 func createVlog(t *testing.T, entries []*entry) []byte {
 	dir, err := ioutil.TempDir("", "badger")
 	require.NoError(t, err)
@@ -588,7 +756,8 @@ func BenchmarkReadWrite(b *testing.B) {
 				dir, err := ioutil.TempDir("", "vlog")
 				y.Check(err)
 				defer os.RemoveAll(dir)
-				err = vl.Open(nil, getTestOptions(dir))
+				// The value log only needs the key registry of the DB, to encrypt with.
+				err = vl.Open(&DB{registry: &keyRegistry{}}, getTestOptions(dir))
 				y.Check(err)
 				defer vl.Close()
 				b.ResetTimer()
@@ -621,7 +790,10 @@ func BenchmarkReadWrite(b *testing.B) {
 							b.Fatalf("Benchmark Read: %v", err)
 						}
 
-						e := valueBytesToEntry(buf)
+						e, err := vl.decodeEntry(buf)
+						if err != nil {
+							b.Fatalf("Benchmark Read: %v", err)
+						}
 						if len(e.Key) != 16 {
 							b.Fatalf("Key is invalid")
 						}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+)
+
+// IVSize is the size of the initialization vectors stored next to the encrypted data.
+const IVSize = aes.BlockSize
+
+// DataKey is an AES key the data is encrypted with. Its ID is recorded next to the encrypted
+// data, so that the key can be looked up to decrypt it.
+type DataKey struct {
+	ID    uint64
+	Key   []byte
+	block cipher.Block
+}
+
+// NewDataKey returns the DataKey for key, which must be 16, 24 or 32 bytes long, to pick
+// AES-128, AES-192 or AES-256.
+func NewDataKey(id uint64, key []byte) (*DataKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, Wrapf(err, "Invalid data key: %d", id)
+	}
+	return &DataKey{ID: id, Key: key, block: block}, nil
+}
+
+// XOR encrypts src into dst with AES in CTR mode, starting from iv. Decrypting is the same
+// operation. dst and src may overlap entirely, or not at all.
+func (dk *DataKey) XOR(dst, src, iv []byte) {
+	dk.NewStream(iv).XORKeyStream(dst, src)
+}
+
+// NewStream returns the AES CTR stream starting from iv, for data which is encrypted in one go
+// but decrypted in pieces, or the other way round.
+func (dk *DataKey) NewStream(iv []byte) cipher.Stream {
+	return cipher.NewCTR(dk.block, iv)
+}
+
+// GenerateIV returns a random initialization vector.
+func GenerateIV() ([]byte, error) {
+	iv := make([]byte, IVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, Wrap(err)
+	}
+	return iv, nil
+}
@@ -48,6 +48,10 @@ var (
 	NumBlockedPuts *expvar.Int
 	// NumMemtableGets is number of memtable gets
 	NumMemtableGets *expvar.Int
+	// NumBlockCacheHits is number of table blocks found in the block cache
+	NumBlockCacheHits *expvar.Int
+	// NumBlockCacheMisses is number of table blocks not found in the block cache
+	NumBlockCacheMisses *expvar.Int
 )
 
 // These variables are global and have cumulative values for all kv stores.
@@ -62,6 +66,8 @@ func init() {
 	NumPuts = expvar.NewInt("badger_puts_total")
 	NumBlockedPuts = expvar.NewInt("badger_blocked_puts_total")
 	NumMemtableGets = expvar.NewInt("badger_memtable_gets_total")
+	NumBlockCacheHits = expvar.NewInt("badger_block_cache_hits_total")
+	NumBlockCacheMisses = expvar.NewInt("badger_block_cache_misses_total")
 	LSMSize = expvar.NewMap("badger_lsm_size_bytes")
 	VlogSize = expvar.NewMap("badger_vlog_size_bytes")
 	PendingWrites = expvar.NewMap("badger_pending_writes_total")
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Writes through RateLimiter.Writer wait for at most this many bytes at a time, so that they go
+// out at a steady pace.
+const rateLimitChunkSize = 1 << 20
+
+// RateLimiter is a token bucket, which limits the rate of some IO to a number of bytes per second.
+// Bursts of up to a second's worth of bytes go through right away. A rate of 0 or less doesn't
+// limit anything.
+type RateLimiter struct {
+	rate  int64 // Atomic. Bytes per second.
+	boost func() float64
+
+	sync.Mutex
+	avail float64 // Bytes which can go through right away. Negative while there are waiters.
+	last  time.Time
+}
+
+// NewRateLimiter returns a RateLimiter letting through rate bytes per second. If boost isn't nil,
+// it's called on each wait, and the rate gets multiplied by the factor it returns. It can return
+// +Inf to lift the limit.
+func NewRateLimiter(rate int64, boost func() float64) *RateLimiter {
+	return &RateLimiter{
+		rate:  rate,
+		boost: boost,
+		avail: float64(rate),
+		last:  time.Now(),
+	}
+}
+
+// SetRate changes the number of bytes let through per second.
+func (r *RateLimiter) SetRate(rate int64) {
+	atomic.StoreInt64(&r.rate, rate)
+}
+
+// Rate returns the number of bytes let through per second.
+func (r *RateLimiter) Rate() int64 {
+	return atomic.LoadInt64(&r.rate)
+}
+
+// Wait blocks until n more bytes can go through.
+func (r *RateLimiter) Wait(n int) {
+	base := r.Rate()
+	if base <= 0 {
+		return
+	}
+	rate := float64(base)
+	if r.boost != nil {
+		rate *= r.boost()
+	}
+	if math.IsInf(rate, 1) {
+		return
+	}
+
+	r.Lock()
+	now := time.Now()
+	r.avail += now.Sub(r.last).Seconds() * rate
+	if r.avail > rate {
+		r.avail = rate
+	}
+	r.last = now
+	// Take the bytes right away, so that the waiters which come after wait for these too.
+	r.avail -= float64(n)
+	var wait time.Duration
+	if r.avail < 0 {
+		wait = time.Duration(-r.avail / rate * float64(time.Second))
+	}
+	r.Unlock()
+
+	time.Sleep(wait)
+}
+
+type rateLimitedWriter struct {
+	w io.Writer
+	r *RateLimiter
+}
+
+func (lw rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > rateLimitChunkSize {
+			chunk = chunk[:rateLimitChunkSize]
+		}
+		lw.r.Wait(len(chunk))
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Writer returns an io.Writer which writes to w at the rate let through by the limiter.
+func (r *RateLimiter) Writer(w io.Writer) io.Writer {
+	return rateLimitedWriter{w: w, r: r}
+}
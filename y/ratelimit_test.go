@@ -0,0 +1,72 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	boost := 1.0
+	r := NewRateLimiter(4<<20, func() float64 { return boost })
+
+	// A second's worth of bytes goes through right away. The next ones have to wait.
+	start := time.Now()
+	r.Wait(4 << 20)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+	r.Wait(1 << 20)
+	require.True(t, time.Since(start) >= 200*time.Millisecond)
+
+	// Boosting the rate shortens the wait, and an infinite boost lifts the limit.
+	boost = 4
+	r.Wait(16 << 20)
+	start = time.Now()
+	r.Wait(2 << 20)
+	elapsed := time.Since(start)
+	require.True(t, elapsed >= 100*time.Millisecond && elapsed < 400*time.Millisecond,
+		"elapsed: %v", elapsed)
+	boost = math.Inf(1)
+	start = time.Now()
+	r.Wait(64 << 20)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+
+	// So does a rate of 0.
+	boost = 1
+	r.SetRate(0)
+	require.Equal(t, int64(0), r.Rate())
+	start = time.Now()
+	r.Wait(64 << 20)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestRateLimitedWriter(t *testing.T) {
+	r := NewRateLimiter(2*rateLimitChunkSize, nil)
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("a"), 3*rateLimitChunkSize)
+
+	start := time.Now()
+	n, err := r.Writer(&buf).Write(data)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+	require.Equal(t, data, buf.Bytes())
+	require.True(t, time.Since(start) >= 400*time.Millisecond)
+}